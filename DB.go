@@ -8,6 +8,7 @@ import (
 	"time"
 
 	_ "github.com/go-sql-driver/mysql" // for sql library
+	mastodon "github.com/hanage999/go-mastodon"
 )
 
 // DB は、データベース接続を格納する。
@@ -162,6 +163,10 @@ func (db DB) stockItems(bot *Persona) (inStock int, err error) {
 		if songs == "" {
 			continue
 		}
+		// 悲しい話題やNGワードを含む記事は詠まない
+		if bot.contentLevel(item.Title, str, songs) != contentOK {
+			continue
+		}
 		newItem := item
 		newItem.Songs = songs
 		myItems = append(myItems, newItem)
@@ -188,6 +193,9 @@ func (db DB) stockItems(bot *Persona) (inStock int, err error) {
 			log.Printf("info: song_candidatesテーブルが更新できませんでした：%s", err)
 			return
 		}
+		for _, item := range myItems {
+			bot.harvestPhrases(db, item.Songs, "news")
+		}
 	}
 
 	tf := time.Now()
@@ -319,3 +327,1291 @@ func (db DB) deleteItem(bot *Persona, item Item) (err error) {
 	}
 	return
 }
+
+// addContestEntryは、お題への応募作品を登録する。既に登録済みならaddedはfalseになる。
+func (db DB) addContestEntry(bot *Persona, entry contestEntry) (added bool, err error) {
+	now := time.Now()
+	res, err := db.Exec(`
+		INSERT IGNORE INTO
+			contest_entries (bot_id, status_id, acct, song, accepted, created_at, updated_at)
+		VALUES
+			(?, ?, ?, ?, ?, ?, ?)`,
+		bot.DBID, string(entry.StatusID), entry.Acct, entry.Song, entry.Accepted, now, now,
+	)
+	if err != nil {
+		log.Printf("info: contest_entriesテーブルが更新できませんでした：%s", err)
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("info: contest_entriesテーブルの更新件数が取得できませんでした：%s", err)
+		return
+	}
+	added = n > 0
+	return
+}
+
+// contestEntriesは、期間中に受け付けた応募作品を取得する。
+func (db DB) contestEntries(bot *Persona, from, to time.Time) (entries []contestEntry, err error) {
+	rows, err := db.Query(`
+		SELECT
+			status_id, acct, song
+		FROM
+			contest_entries
+		WHERE
+			bot_id = ? AND accepted = 1 AND created_at >= ? AND created_at < ?
+		ORDER BY
+			id`,
+		bot.DBID, from, to,
+	)
+	if err != nil {
+		log.Printf("info: %s の応募作品を集め損ねました：%s", bot.Name, err)
+		return
+	}
+	defer rows.Close()
+
+	entries = make([]contestEntry, 0)
+	for rows.Next() {
+		var id, acct, song string
+		if err := rows.Scan(&id, &acct, &song); err != nil {
+			log.Printf("info: contest_entriesテーブルから一行の情報取得に失敗しました：%s", err)
+			continue
+		}
+		entries = append(entries, contestEntry{StatusID: mastodon.ID(id), Acct: acct, Song: song, Accepted: true})
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("info: contest_entriesテーブルの行読み込みに結局失敗しました：%s", err)
+	}
+	return
+}
+
+// contestStartedAtは、現在の募集期間の開始時刻を取得する。未設定ならゼロ値を返す。
+func (db DB) contestStartedAt(bot *Persona) (t time.Time, err error) {
+	var nt sql.NullTime
+	if err = db.QueryRow(`
+		SELECT
+			contest_started_at
+		FROM
+			bots
+		WHERE
+			id = ?`,
+		bot.DBID,
+	).Scan(&nt); err != nil {
+		log.Printf("info: botsテーブルから %s の募集期間の取得に失敗しました：%s", bot.Name, err)
+		return
+	}
+	t = nt.Time
+	return
+}
+
+// setContestStartedAtは、募集期間の開始時刻を更新する。
+func (db DB) setContestStartedAt(bot *Persona, t time.Time) (err error) {
+	_, err = db.Exec(`
+		UPDATE bots
+		SET contest_started_at = ?, updated_at = ?
+		WHERE id = ?`,
+		t,
+		time.Now(),
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: %s のcontest_started_atが更新できませんでした：%s", bot.Name, err)
+	}
+	return
+}
+
+// rengaChainByLinkは、句のステータスIDから、それを含む巻き終えていない連歌を取得する。なければゼロ値を返す。
+func (db DB) rengaChainByLink(bot *Persona, statusID mastodon.ID) (chain rengaChain, err error) {
+	var root, last string
+	err = db.QueryRow(`
+		SELECT
+			renga_chains.id, renga_chains.root_status_id, renga_chains.last_status_id,
+			renga_chains.last_acct, renga_chains.next_form, renga_chains.links,
+			COALESCE((
+				SELECT acct FROM renga_links AS roots
+				WHERE roots.chain_id = renga_chains.id AND roots.status_id = renga_chains.root_status_id
+			), '')
+		FROM
+			renga_links
+		INNER JOIN
+			renga_chains
+		ON
+			renga_links.chain_id = renga_chains.id
+		WHERE
+			renga_chains.bot_id = ? AND renga_chains.finished = 0 AND renga_links.status_id = ?`,
+		bot.DBID, string(statusID),
+	).Scan(&chain.ID, &root, &last, &chain.LastAcct, &chain.NextForm, &chain.Links, &chain.RootAcct)
+	switch err {
+	case sql.ErrNoRows:
+		err = nil
+	case nil:
+		chain.RootStatusID = mastodon.ID(root)
+		chain.LastStatusID = mastodon.ID(last)
+	default:
+		log.Printf("info: renga_chainsテーブルから %s の連歌の取得に失敗しました：%s", bot.Name, err)
+	}
+	return
+}
+
+// addRengaChainは、発句から新しい連歌を登録する。
+func (db DB) addRengaChain(bot *Persona, link rengaLink) (err error) {
+	now := time.Now()
+	res, err := db.Exec(`
+		INSERT INTO
+			renga_chains (bot_id, root_status_id, last_status_id, last_acct, next_form, links, created_at, updated_at)
+		VALUES
+			(?, ?, ?, ?, ?, ?, ?, ?)`,
+		bot.DBID, string(link.StatusID), string(link.StatusID), link.Acct, "短句", 1, now, now,
+	)
+	if err != nil {
+		log.Printf("info: renga_chainsテーブルが更新できませんでした：%s", err)
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		log.Printf("info: renga_chainsテーブルの新しいIDが取得できませんでした：%s", err)
+		return
+	}
+
+	return db.insertRengaLink(int(id), link)
+}
+
+// addRengaLinkは、連歌に付句を加えて次の句の形を切り替える。
+// 他の付句が先に加わっていたら何もせず、linkedはfalseになる。
+func (db DB) addRengaLink(bot *Persona, chain rengaChain, link rengaLink) (linked bool, err error) {
+	next := "長句"
+	if chain.NextForm == "長句" {
+		next = "短句"
+	}
+
+	res, err := db.Exec(`
+		UPDATE renga_chains
+		SET last_status_id = ?, last_acct = ?, next_form = ?, links = links + 1, updated_at = ?
+		WHERE id = ? AND last_status_id = ? AND finished = 0`,
+		string(link.StatusID), link.Acct, next, time.Now(),
+		chain.ID, string(chain.LastStatusID),
+	)
+	if err != nil {
+		log.Printf("info: %s の連歌 %d が更新できませんでした：%s", bot.Name, chain.ID, err)
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return
+	}
+
+	if err = db.insertRengaLink(chain.ID, link); err != nil {
+		return
+	}
+	linked = true
+	return
+}
+
+// insertRengaLinkは、renga_linksテーブルに一句を登録する。
+func (db DB) insertRengaLink(chainID int, link rengaLink) (err error) {
+	_, err = db.Exec(`
+		INSERT IGNORE INTO
+			renga_links (chain_id, status_id, acct, verse, created_at)
+		VALUES
+			(?, ?, ?, ?, ?)`,
+		chainID, string(link.StatusID), link.Acct, link.Verse, time.Now(),
+	)
+	if err != nil {
+		log.Printf("info: renga_linksテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// finishRengaChainは、連歌を巻き終えたことにする。
+func (db DB) finishRengaChain(bot *Persona, chain rengaChain) (err error) {
+	_, err = db.Exec(`
+		UPDATE renga_chains
+		SET finished = 1, updated_at = ?
+		WHERE id = ? AND bot_id = ?`,
+		time.Now(),
+		chain.ID,
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: %s の連歌 %d を巻き終えられませんでした：%s", bot.Name, chain.ID, err)
+	}
+	return
+}
+
+// rengaLinksは、連歌の句を付けられた順に取得する。
+func (db DB) rengaLinks(chain rengaChain) (links []rengaLink, err error) {
+	rows, err := db.Query(`
+		SELECT
+			status_id, acct, verse
+		FROM
+			renga_links
+		WHERE
+			chain_id = ?
+		ORDER BY
+			id`,
+		chain.ID,
+	)
+	if err != nil {
+		log.Printf("info: 連歌 %d の句を集め損ねました：%s", chain.ID, err)
+		return
+	}
+	defer rows.Close()
+
+	links = make([]rengaLink, 0)
+	for rows.Next() {
+		var id, acct, verse string
+		if err := rows.Scan(&id, &acct, &verse); err != nil {
+			log.Printf("info: renga_linksテーブルから一行の情報取得に失敗しました：%s", err)
+			continue
+		}
+		links = append(links, rengaLink{StatusID: mastodon.ID(id), Acct: acct, Verse: verse})
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("info: renga_linksテーブルの行読み込みに結局失敗しました：%s", err)
+	}
+	return
+}
+
+// addKarutaQuizは、かるたの出題を記録する。
+func (db DB) addKarutaQuiz(bot *Persona, quiz karutaQuiz) (err error) {
+	_, err = db.Exec(`
+		INSERT IGNORE INTO
+			karuta_quizzes (bot_id, question_status_id, poem_number, acct, created_at)
+		VALUES
+			(?, ?, ?, ?, ?)`,
+		bot.DBID, string(quiz.QuestionID), quiz.Number, quiz.Acct, time.Now(),
+	)
+	if err != nil {
+		log.Printf("info: karuta_quizzesテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// karutaQuizByQuestionは、出題のステータスIDから未回答のかるたクイズを取得する。なければゼロ値を返す。
+func (db DB) karutaQuizByQuestion(bot *Persona, statusID mastodon.ID) (quiz karutaQuiz, err error) {
+	err = db.QueryRow(`
+		SELECT
+			id, poem_number, acct
+		FROM
+			karuta_quizzes
+		WHERE
+			bot_id = ? AND question_status_id = ? AND answered = 0`,
+		bot.DBID, string(statusID),
+	).Scan(&quiz.ID, &quiz.Number, &quiz.Acct)
+	switch err {
+	case sql.ErrNoRows:
+		err = nil
+	case nil:
+		quiz.QuestionID = statusID
+	default:
+		log.Printf("info: karuta_quizzesテーブルから %s の出題の取得に失敗しました：%s", bot.Name, err)
+	}
+	return
+}
+
+// closeKarutaQuizは、かるたクイズを回答済みにする。既に回答済みならclosedはfalseになる。
+func (db DB) closeKarutaQuiz(quiz karutaQuiz) (closed bool, err error) {
+	res, err := db.Exec(`
+		UPDATE karuta_quizzes
+		SET answered = 1
+		WHERE id = ? AND answered = 0`,
+		quiz.ID,
+	)
+	if err != nil {
+		log.Printf("info: かるたクイズ %d を回答済みにできませんでした：%s", quiz.ID, err)
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("info: karuta_quizzesテーブルの更新件数が取得できませんでした：%s", err)
+		return
+	}
+	closed = n > 0
+	return
+}
+
+// addKarutaScoreは、かるたの成績に一問ぶんの結果を加える。
+func (db DB) addKarutaScore(bot *Persona, acct string, correct bool) (err error) {
+	c := 0
+	if correct {
+		c = 1
+	}
+	now := time.Now()
+	_, err = db.Exec(`
+		INSERT INTO
+			karuta_scores (bot_id, acct, correct, answered, created_at, updated_at)
+		VALUES
+			(?, ?, ?, 1, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			correct = correct + VALUES(correct), answered = answered + 1, updated_at = VALUES(updated_at)`,
+		bot.DBID, acct, c, now, now,
+	)
+	if err != nil {
+		log.Printf("info: karuta_scoresテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// karutaScoreは、かるたの通算成績を取得する。
+func (db DB) karutaScore(bot *Persona, acct string) (correct, answered int, err error) {
+	err = db.QueryRow(`
+		SELECT
+			correct, answered
+		FROM
+			karuta_scores
+		WHERE
+			bot_id = ? AND acct = ?`,
+		bot.DBID, acct,
+	).Scan(&correct, &answered)
+	switch err {
+	case sql.ErrNoRows, nil:
+		err = nil
+	default:
+		log.Printf("info: karuta_scoresテーブルから %s の成績の取得に失敗しました：%s", acct, err)
+	}
+	return
+}
+
+// addPhrasesは、句のバンクに句を登録する。
+func (db DB) addPhrases(bot *Persona, phrases []bankPhrase) (err error) {
+	if len(phrases) == 0 {
+		return
+	}
+
+	vsts := make([]string, 0)
+	params := make([]interface{}, 0)
+	now := time.Now()
+	for _, p := range phrases {
+		vsts = append(vsts, "(?, ?, ?, ?, ?, ?)")
+		params = append(params, bot.DBID, p.Surface, p.Reading, p.MoraCount, p.Source, now)
+	}
+	_, err = db.Exec(`
+		INSERT IGNORE INTO
+			phrase_bank (bot_id, surface, reading, mora_count, source, created_at)
+		VALUES `+strings.Join(vsts, ", "),
+		params...,
+	)
+	if err != nil {
+		log.Printf("info: phrase_bankテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// phraseCountは、句のバンクにある、出どころがsourceの句の数を取得する。
+func (db DB) phraseCount(bot *Persona, source string) (n int, err error) {
+	if err = db.QueryRow(`
+		SELECT
+			COUNT(id)
+		FROM phrase_bank
+		WHERE bot_id = ? AND source = ?`,
+		bot.DBID, source,
+	).Scan(&n); err != nil {
+		log.Printf("info: phrase_bankテーブルから %s の句の数を取得し損ねました：%s", bot.Name, err)
+	}
+	return
+}
+
+// stockSongsは、投稿候補にストックしてある短歌を全て取得する。
+func (db DB) stockSongs(bot *Persona) (songs []string, err error) {
+	rows, err := db.Query(`
+		SELECT
+			songs
+		FROM
+			song_candidates
+		WHERE
+			bot_id = ?`,
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: %s の投稿候補の短歌を集め損ねました：%s", bot.Name, err)
+		return
+	}
+	defer rows.Close()
+
+	songs = make([]string, 0)
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			log.Printf("info: song_candidatesテーブルから一行の情報取得に失敗しました：%s", err)
+			continue
+		}
+		songs = append(songs, s)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("info: song_candidatesテーブルの行読み込みに結局失敗しました：%s", err)
+	}
+	return
+}
+
+// phrasesContainingは、句のバンクから言葉を含む句をランダムな順で取得する。
+func (db DB) phrasesContaining(bot *Persona, word string) (phrases []bankPhrase, err error) {
+	esc := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(word)
+	return db.queryPhrases(bot, `
+		SELECT
+			surface, reading, mora_count, source
+		FROM
+			phrase_bank
+		WHERE
+			bot_id = ? AND surface LIKE ?
+		ORDER BY
+			RAND()
+		LIMIT 10`,
+		bot.DBID, "%"+esc+"%",
+	)
+}
+
+// randomPhrasesは、句のバンクから指定の拍数の句をランダムにn件取得する。
+func (db DB) randomPhrases(bot *Persona, moraCount, n int) (phrases []bankPhrase, err error) {
+	return db.queryPhrases(bot, `
+		SELECT
+			surface, reading, mora_count, source
+		FROM
+			phrase_bank
+		WHERE
+			bot_id = ? AND mora_count = ?
+		ORDER BY
+			RAND()
+		LIMIT ?`,
+		bot.DBID, moraCount, n,
+	)
+}
+
+// queryPhrasesは、phrase_bankテーブルへの問い合わせ結果を句のスライスにする。
+func (db DB) queryPhrases(bot *Persona, query string, args ...interface{}) (phrases []bankPhrase, err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("info: %s が句のバンクから句を集め損ねました：%s", bot.Name, err)
+		return
+	}
+	defer rows.Close()
+
+	phrases = make([]bankPhrase, 0)
+	for rows.Next() {
+		var p bankPhrase
+		if err := rows.Scan(&p.Surface, &p.Reading, &p.MoraCount, &p.Source); err != nil {
+			log.Printf("info: phrase_bankテーブルから一行の情報取得に失敗しました：%s", err)
+			continue
+		}
+		phrases = append(phrases, p)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("info: phrase_bankテーブルの行読み込みに結局失敗しました：%s", err)
+	}
+	return
+}
+
+// lastStatusIDは、最後に見たホームタイムラインのステータスIDを取得する。未設定なら空文字列を返す。
+func (db DB) lastStatusID(bot *Persona) (id mastodon.ID, err error) {
+	var ns sql.NullString
+	if err = db.QueryRow(`
+		SELECT
+			last_status_id
+		FROM
+			bots
+		WHERE
+			id = ?`,
+		bot.DBID,
+	).Scan(&ns); err != nil {
+		log.Printf("info: botsテーブルから %s の最後に見たステータスの取得に失敗しました：%s", bot.Name, err)
+		return
+	}
+	id = mastodon.ID(ns.String)
+	return
+}
+
+// setLastStatusIDは、最後に見たホームタイムラインのステータスIDを、記録済みのものより新しい場合に限って更新する。
+func (db DB) setLastStatusID(bot *Persona, id mastodon.ID) (err error) {
+	_, err = db.Exec(`
+		UPDATE bots
+		SET last_status_id = ?, updated_at = ?
+		WHERE
+			id = ? AND (
+				last_status_id IS NULL OR
+				CHAR_LENGTH(last_status_id) < CHAR_LENGTH(?) OR
+				(CHAR_LENGTH(last_status_id) = CHAR_LENGTH(?) AND last_status_id < ?)
+			)`,
+		string(id), time.Now(),
+		bot.DBID, string(id), string(id), string(id),
+	)
+	if err != nil {
+		log.Printf("info: %s のlast_status_idが更新できませんでした：%s", bot.Name, err)
+	}
+	return
+}
+
+// claimProcessedは、ステータスや通知を処理済みとして記録する。既に記録があればclaimedはfalseになる。
+func (db DB) claimProcessed(bot *Persona, kind string, id mastodon.ID) (claimed bool, err error) {
+	res, err := db.Exec(`
+		INSERT IGNORE INTO
+			processed_statuses (bot_id, kind, status_id, created_at)
+		VALUES
+			(?, ?, ?, ?)`,
+		bot.DBID, kind, string(id), time.Now(),
+	)
+	if err != nil {
+		log.Printf("info: processed_statusesテーブルが更新できませんでした：%s", err)
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("info: processed_statusesテーブルの更新件数が取得できませんでした：%s", err)
+		return
+	}
+	claimed = n > 0
+	return
+}
+
+// releaseProcessedは、処理済みの記録を取り消す。
+func (db DB) releaseProcessed(bot *Persona, kind string, id mastodon.ID) (err error) {
+	_, err = db.Exec(`
+		DELETE FROM processed_statuses
+		WHERE bot_id = ? AND kind = ? AND status_id = ?`,
+		bot.DBID, kind, string(id),
+	)
+	if err != nil {
+		log.Printf("info: processed_statusesテーブルから削除できませんでした：%s", err)
+	}
+	return
+}
+
+// expireProcessedは、beforeより前の処理済みの記録を削除する。
+func (db DB) expireProcessed(bot *Persona, before time.Time) (err error) {
+	_, err = db.Exec(`
+		DELETE FROM processed_statuses
+		WHERE bot_id = ? AND created_at < ?`,
+		bot.DBID, before,
+	)
+	if err != nil {
+		log.Printf("alert: %s のDBエラーです：%s", bot.Name, err)
+	}
+	return
+}
+
+// addReplyは、投稿とbotの返信の対応を記録する。同じ投稿への同じ種類の返信があれば置き換える。
+func (db DB) addReply(bot *Persona, rep botReply) (err error) {
+	now := time.Now()
+	_, err = db.Exec(`
+		INSERT INTO
+			replies (bot_id, status_id, kind, reply_id, acct, tankas, created_at, updated_at)
+		VALUES
+			(?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			reply_id = VALUES(reply_id), tankas = VALUES(tankas), updated_at = VALUES(updated_at)`,
+		bot.DBID, string(rep.StatusID), rep.Kind, string(rep.ReplyID), rep.Acct, rep.Tankas, now, now,
+	)
+	if err != nil {
+		log.Printf("info: repliesテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// replyToは、投稿に短歌を知らせたbotの返信を取得する。なければゼロ値を返す。
+func (db DB) replyTo(bot *Persona, statusID mastodon.ID) (rep botReply, err error) {
+	var replyID string
+	err = db.QueryRow(`
+		SELECT
+			reply_id, acct, tankas
+		FROM
+			replies
+		WHERE
+			bot_id = ? AND status_id = ? AND kind = ?`,
+		bot.DBID, string(statusID), replyTanka,
+	).Scan(&replyID, &rep.Acct, &rep.Tankas)
+	switch err {
+	case sql.ErrNoRows:
+		err = nil
+	case nil:
+		rep.StatusID = statusID
+		rep.Kind = replyTanka
+		rep.ReplyID = mastodon.ID(replyID)
+	default:
+		log.Printf("info: repliesテーブルから %s の返信の取得に失敗しました：%s", bot.Name, err)
+	}
+	return
+}
+
+// repliesToは、投稿へのbotの返信を、種類を問わず全て取得する。
+func (db DB) repliesTo(bot *Persona, statusID mastodon.ID) (reps []botReply, err error) {
+	rows, err := db.Query(`
+		SELECT
+			kind, reply_id, acct, tankas
+		FROM
+			replies
+		WHERE
+			bot_id = ? AND status_id = ?`,
+		bot.DBID, string(statusID),
+	)
+	if err != nil {
+		log.Printf("info: repliesテーブルから %s の返信の取得に失敗しました：%s", bot.Name, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rep := botReply{StatusID: statusID}
+		var rid string
+		if err = rows.Scan(&rep.Kind, &rid, &rep.Acct, &rep.Tankas); err != nil {
+			log.Printf("info: repliesテーブルの行読み込みに失敗しました：%s", err)
+			return
+		}
+		rep.ReplyID = mastodon.ID(rid)
+		reps = append(reps, rep)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("info: repliesテーブルの行読み込みに結局失敗しました：%s", err)
+	}
+	return
+}
+
+// deleteReplyは、投稿とbotの返信の対応を削除する。
+func (db DB) deleteReply(bot *Persona, rep botReply) (err error) {
+	_, err = db.Exec(`
+		DELETE FROM replies
+		WHERE bot_id = ? AND status_id = ? AND kind = ?`,
+		bot.DBID, string(rep.StatusID), rep.Kind,
+	)
+	if err != nil {
+		log.Printf("info: repliesテーブルから削除できませんでした：%s", err)
+	}
+	return
+}
+
+// repliedStatusesは、sinceより後に返信した投稿のうち、checkedBefore以降にまだあるかを確かめていないものを、重複なしで取得する。
+func (db DB) repliedStatuses(bot *Persona, since, checkedBefore time.Time) (ids []mastodon.ID, err error) {
+	rows, err := db.Query(`
+		SELECT
+			status_id
+		FROM
+			replies
+		WHERE
+			bot_id = ? AND created_at > ?
+		GROUP BY
+			status_id
+		HAVING
+			MAX(checked_at) IS NULL OR MAX(checked_at) < ?
+		ORDER BY
+			MIN(created_at)`,
+		bot.DBID, since, checkedBefore,
+	)
+	if err != nil {
+		log.Printf("info: repliesテーブルから %s の返信した投稿の取得に失敗しました：%s", bot.Name, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sid string
+		if err = rows.Scan(&sid); err != nil {
+			log.Printf("info: repliesテーブルの行読み込みに失敗しました：%s", err)
+			return
+		}
+		ids = append(ids, mastodon.ID(sid))
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("info: repliesテーブルの行読み込みに結局失敗しました：%s", err)
+	}
+	return
+}
+
+// setRepliesCheckedは、投稿がまだあるかを確かめた時刻を、その投稿への返信の記録に残す。
+func (db DB) setRepliesChecked(bot *Persona, statusID mastodon.ID, t time.Time) (err error) {
+	_, err = db.Exec(`
+		UPDATE replies
+		SET checked_at = ?
+		WHERE bot_id = ? AND status_id = ?`,
+		t, bot.DBID, string(statusID),
+	)
+	if err != nil {
+		log.Printf("info: repliesテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// accountPrefsは、アカウントの通知設定を取得する。設定がなければ既定の設定を返す。
+func (db DB) accountPrefs(bot *Persona, acct string) (prefs accountPrefs, err error) {
+	prefs.Acct = acct
+	err = db.QueryRow(`
+		SELECT
+			muted, policy
+		FROM
+			account_prefs
+		WHERE
+			bot_id = ? AND acct = ?`,
+		bot.DBID, acct,
+	).Scan(&prefs.Muted, &prefs.Policy)
+	switch err {
+	case sql.ErrNoRows, nil:
+		err = nil
+	default:
+		log.Printf("info: account_prefsテーブルから %s の設定の取得に失敗しました：%s", acct, err)
+	}
+	return
+}
+
+// setAccountPrefsは、アカウントの通知設定を保存する。
+func (db DB) setAccountPrefs(bot *Persona, prefs accountPrefs) (err error) {
+	now := time.Now()
+	_, err = db.Exec(`
+		INSERT INTO
+			account_prefs (bot_id, acct, muted, policy, created_at, updated_at)
+		VALUES
+			(?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			muted = VALUES(muted), policy = VALUES(policy), updated_at = VALUES(updated_at)`,
+		bot.DBID, prefs.Acct, prefs.Muted, prefs.Policy, now, now,
+	)
+	if err != nil {
+		log.Printf("info: account_prefsテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// unfollowedAcctsは、botがフォローを外したアカウントと、その理由を取得する。
+func (db DB) unfollowedAccts(bot *Persona) (accts map[string]string, err error) {
+	rows, err := db.Query(`
+		SELECT
+			acct, unfollowed
+		FROM
+			account_prefs
+		WHERE
+			bot_id = ? AND unfollowed != ''`,
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: account_prefsテーブルから %s がフォローを外したアカウントを取得し損ねました：%s", bot.Name, err)
+		return
+	}
+	defer rows.Close()
+
+	accts = make(map[string]string)
+	for rows.Next() {
+		var acct, reason string
+		if err := rows.Scan(&acct, &reason); err != nil {
+			log.Printf("info: account_prefsテーブルから一行の情報取得に失敗しました：%s", err)
+			continue
+		}
+		accts[acct] = reason
+	}
+	err = rows.Err()
+	return
+}
+
+// setUnfollowedは、アカウントのフォローを外した理由を保存する。空なら記録を消す。
+func (db DB) setUnfollowed(bot *Persona, acct, reason string) (err error) {
+	now := time.Now()
+	_, err = db.Exec(`
+		INSERT INTO
+			account_prefs (bot_id, acct, unfollowed, created_at, updated_at)
+		VALUES
+			(?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			unfollowed = VALUES(unfollowed), updated_at = VALUES(updated_at)`,
+		bot.DBID, acct, reason, now, now,
+	)
+	if err != nil {
+		log.Printf("info: account_prefsテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// followsSyncedAtは、初めてフォロー関係を見直した時刻を取得する。まだならゼロ値を返す。
+func (db DB) followsSyncedAt(bot *Persona) (t time.Time, err error) {
+	var nt sql.NullTime
+	if err = db.QueryRow(`
+		SELECT
+			follows_synced_at
+		FROM
+			bots
+		WHERE
+			id = ?`,
+		bot.DBID,
+	).Scan(&nt); err != nil {
+		log.Printf("info: botsテーブルから %s のフォロー関係を見直した時刻の取得に失敗しました：%s", bot.Name, err)
+		return
+	}
+	t = nt.Time
+	return
+}
+
+// setFollowsSyncedAtは、初めてフォロー関係を見直した時刻を記録する。
+func (db DB) setFollowsSyncedAt(bot *Persona, t time.Time) (err error) {
+	_, err = db.Exec(`
+		UPDATE bots
+		SET follows_synced_at = ?, updated_at = ?
+		WHERE id = ?`,
+		t,
+		time.Now(),
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: %s のfollows_synced_atが更新できませんでした：%s", bot.Name, err)
+	}
+	return
+}
+
+// replyCountsは、アカウントへの直近一時間と一日の返信数、最後に返信した時刻、全体での直近一時間の返信数を取得する。
+// 返信を後で削除しても数が減らないように、返信の記録ではなく、消さない返信のログから数える。
+func (db DB) replyCounts(bot *Persona, acct string, now time.Time) (hour, day int, last time.Time, globalHour int, err error) {
+	var nt sql.NullTime
+	if err = db.QueryRow(`
+		SELECT
+			COUNT(*), COALESCE(SUM(created_at > ?), 0), MAX(created_at)
+		FROM
+			reply_log
+		WHERE
+			bot_id = ? AND acct = ? AND created_at > ?`,
+		now.Add(-time.Hour), bot.DBID, acct, now.Add(-24*time.Hour),
+	).Scan(&day, &hour, &nt); err != nil {
+		log.Printf("info: reply_logテーブルから %s への返信数の取得に失敗しました：%s", acct, err)
+		return
+	}
+	last = nt.Time
+
+	if err = db.QueryRow(`
+		SELECT
+			COUNT(*)
+		FROM
+			reply_log
+		WHERE
+			bot_id = ? AND created_at > ?`,
+		bot.DBID, now.Add(-time.Hour),
+	).Scan(&globalHour); err != nil {
+		log.Printf("info: reply_logテーブルから %s の返信数の取得に失敗しました：%s", bot.Name, err)
+	}
+	return
+}
+
+// logReplyは、返信のログに一件加える。
+func (db DB) logReply(bot *Persona, statusID mastodon.ID, kind, acct string) (err error) {
+	_, err = db.Exec(`
+		INSERT INTO
+			reply_log (bot_id, status_id, kind, acct, created_at)
+		VALUES
+			(?, ?, ?, ?, ?)`,
+		bot.DBID, string(statusID), kind, acct, time.Now(),
+	)
+	if err != nil {
+		log.Printf("info: reply_logテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// unlogReplyは、投稿できなかった返信を、返信のログから一件取り消す。
+func (db DB) unlogReply(bot *Persona, statusID mastodon.ID, kind string) (err error) {
+	_, err = db.Exec(`
+		DELETE FROM reply_log
+		WHERE bot_id = ? AND status_id = ? AND kind = ?
+		ORDER BY id DESC
+		LIMIT 1`,
+		bot.DBID, string(statusID), kind,
+	)
+	if err != nil {
+		log.Printf("info: reply_logテーブルから削除できませんでした：%s", err)
+	}
+	return
+}
+
+// expireReplyLogは、返信のログからbeforeより古いものを削除する。
+func (db DB) expireReplyLog(bot *Persona, before time.Time) (err error) {
+	_, err = db.Exec(`
+		DELETE FROM reply_log
+		WHERE bot_id = ? AND created_at < ?`,
+		bot.DBID, before,
+	)
+	if err != nil {
+		log.Printf("alert: %s のDBエラーです：%s", bot.Name, err)
+	}
+	return
+}
+
+// addSuppressedは、返信を控えた短歌や、まとめて紹介する短歌を記録する。
+func (db DB) addSuppressed(bot *Persona, sup suppressedTanka) (err error) {
+	_, err = db.Exec(`
+		INSERT IGNORE INTO
+			suppressed_tankas (bot_id, status_id, acct, url, tankas, reason, created_at)
+		VALUES
+			(?, ?, ?, ?, ?, ?, ?)`,
+		bot.DBID, string(sup.StatusID), sup.Acct, sup.URL, sup.Tankas, sup.Reason, time.Now(),
+	)
+	if err != nil {
+		log.Printf("info: suppressed_tankasテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// undigestedは、まだまとめて紹介していない短歌を古い順に取得する。
+func (db DB) undigested(bot *Persona) (sups []suppressedTanka, err error) {
+	rows, err := db.Query(`
+		SELECT
+			id, status_id, acct, url, tankas, reason
+		FROM
+			suppressed_tankas
+		WHERE
+			bot_id = ? AND digested = 0
+		ORDER BY
+			id`,
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: suppressed_tankasテーブルから %s の短歌の取得に失敗しました：%s", bot.Name, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sup suppressedTanka
+		var sid string
+		if err = rows.Scan(&sup.ID, &sid, &sup.Acct, &sup.URL, &sup.Tankas, &sup.Reason); err != nil {
+			log.Printf("info: suppressed_tankasテーブルの行読み込みに失敗しました：%s", err)
+			return
+		}
+		sup.StatusID = mastodon.ID(sid)
+		sups = append(sups, sup)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("info: suppressed_tankasテーブルの行読み込みに結局失敗しました：%s", err)
+	}
+	return
+}
+
+// markDigestedは、短歌をまとめて紹介済みにする。
+func (db DB) markDigested(bot *Persona, sups []suppressedTanka) (err error) {
+	if len(sups) == 0 {
+		return
+	}
+
+	qs := make([]string, 0)
+	params := []interface{}{bot.DBID}
+	for _, sup := range sups {
+		qs = append(qs, "?")
+		params = append(params, sup.ID)
+	}
+	_, err = db.Exec(`
+		UPDATE suppressed_tankas
+		SET digested = 1
+		WHERE bot_id = ? AND id IN (`+strings.Join(qs, ", ")+`)`,
+		params...,
+	)
+	if err != nil {
+		log.Printf("info: suppressed_tankasテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// addFollowRequestは、承認待ちのフォローリクエストを記録する。
+func (db DB) addFollowRequest(bot *Persona, req followRequest) (err error) {
+	_, err = db.Exec(`
+		INSERT IGNORE INTO
+			follow_requests (bot_id, account_id, acct, created_at)
+		VALUES
+			(?, ?, ?, ?)`,
+		bot.DBID, string(req.AccountID), req.Acct, time.Now(),
+	)
+	if err != nil {
+		log.Printf("info: follow_requestsテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// followRequestByAcctは、acctの承認待ちのフォローリクエストを取得する。なければゼロ値を返す。
+func (db DB) followRequestByAcct(bot *Persona, acct string) (req followRequest, err error) {
+	var id string
+	err = db.QueryRow(`
+		SELECT
+			account_id, created_at
+		FROM
+			follow_requests
+		WHERE
+			bot_id = ? AND acct = ?`,
+		bot.DBID, acct,
+	).Scan(&id, &req.CreatedAt)
+	switch err {
+	case sql.ErrNoRows:
+		err = nil
+	case nil:
+		req.AccountID = mastodon.ID(id)
+		req.Acct = acct
+	default:
+		log.Printf("info: follow_requestsテーブルから %s のリクエストの取得に失敗しました：%s", acct, err)
+	}
+	return
+}
+
+// followRequestsは、承認待ちのフォローリクエストを古い順に取得する。
+func (db DB) followRequests(bot *Persona) (reqs []followRequest, err error) {
+	rows, err := db.Query(`
+		SELECT
+			account_id, acct, created_at
+		FROM
+			follow_requests
+		WHERE
+			bot_id = ?
+		ORDER BY
+			created_at`,
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: follow_requestsテーブルから %s のリクエストの取得に失敗しました：%s", bot.Name, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var req followRequest
+		var id string
+		if err = rows.Scan(&id, &req.Acct, &req.CreatedAt); err != nil {
+			log.Printf("info: follow_requestsテーブルの行読み込みに失敗しました：%s", err)
+			return
+		}
+		req.AccountID = mastodon.ID(id)
+		reqs = append(reqs, req)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("info: follow_requestsテーブルの行読み込みに結局失敗しました：%s", err)
+	}
+	return
+}
+
+// deleteFollowRequestは、処理済みのフォローリクエストを削除する。
+func (db DB) deleteFollowRequest(bot *Persona, accountID mastodon.ID) (err error) {
+	_, err = db.Exec(`
+		DELETE FROM follow_requests
+		WHERE bot_id = ? AND account_id = ?`,
+		bot.DBID, string(accountID),
+	)
+	if err != nil {
+		log.Printf("info: follow_requestsテーブルから削除できませんでした：%s", err)
+	}
+	return
+}
+
+// blocksは、DBに保存したブロックリストを取得する。
+func (db DB) blocks(bot *Persona) (entries []blockEntry, err error) {
+	rows, err := db.Query(`
+		SELECT
+			kind, value, source
+		FROM
+			blocklist
+		WHERE
+			bot_id = ?`,
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: blocklistテーブルから %s のブロックリストの取得に失敗しました：%s", bot.Name, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e blockEntry
+		if err = rows.Scan(&e.Kind, &e.Value, &e.Source); err != nil {
+			log.Printf("info: blocklistテーブルの行読み込みに失敗しました：%s", err)
+			return
+		}
+		entries = append(entries, e)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("info: blocklistテーブルの行読み込みに結局失敗しました：%s", err)
+	}
+	return
+}
+
+// addBlockは、ブロックリストに項目を加える。
+func (db DB) addBlock(bot *Persona, e blockEntry) (err error) {
+	_, err = db.Exec(`
+		INSERT INTO
+			blocklist (bot_id, kind, value, source, created_at)
+		VALUES
+			(?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			source = VALUES(source)`,
+		bot.DBID, e.Kind, e.Value, e.Source, time.Now(),
+	)
+	if err != nil {
+		log.Printf("info: blocklistテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// deleteBlockは、ブロックリストから項目を外す。
+func (db DB) deleteBlock(bot *Persona, e blockEntry) (err error) {
+	_, err = db.Exec(`
+		DELETE FROM blocklist
+		WHERE bot_id = ? AND kind = ? AND value = ?`,
+		bot.DBID, e.Kind, e.Value,
+	)
+	if err != nil {
+		log.Printf("info: blocklistテーブルから削除できませんでした：%s", err)
+	}
+	return
+}
+
+// replaceBlocksは、出どころがsourceのブロックリストの項目を、entriesで入れ替える。
+func (db DB) replaceBlocks(bot *Persona, source string, entries []blockEntry) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("info: %s のトランザクションが開始できませんでした：%s", bot.Name, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`
+		DELETE FROM blocklist
+		WHERE bot_id = ? AND source = ?`,
+		bot.DBID, source,
+	); err != nil {
+		log.Printf("info: blocklistテーブルから削除できませんでした：%s", err)
+		return
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if _, err = tx.Exec(`
+			INSERT IGNORE INTO
+				blocklist (bot_id, kind, value, source, created_at)
+			VALUES
+				(?, ?, ?, ?, ?)`,
+			bot.DBID, e.Kind, normalizeBlock(e.Kind, e.Value), source, now,
+		); err != nil {
+			log.Printf("info: blocklistテーブルが更新できませんでした：%s", err)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("info: blocklistテーブルの更新が確定できませんでした：%s", err)
+	}
+	return
+}
+
+// stockCountは、投稿候補のストック数を取得する。
+func (db DB) stockCount(bot *Persona) (n int, err error) {
+	if err = db.QueryRow(`
+		SELECT
+			COUNT(id)
+		FROM song_candidates
+		WHERE bot_id = ?`,
+		bot.DBID,
+	).Scan(&n); err != nil {
+		log.Printf("info: song_candidatesテーブルから %s のネタストック数を取得し損ねました：%s", bot.Name, err)
+	}
+	return
+}
+
+// addNewsTootは、ネットの記事から拾った短歌の投稿と、元の記事の対応を記録する。
+func (db DB) addNewsToot(bot *Persona, statusID mastodon.ID, item Item, source string) (err error) {
+	_, err = db.Exec(`
+		INSERT IGNORE INTO
+			news_toots (bot_id, status_id, item_id, url, source, songs, created_at)
+		VALUES
+			(?, ?, ?, ?, ?, ?, ?)`,
+		bot.DBID, string(statusID), item.ID, item.URL, source, item.Songs, time.Now(),
+	)
+	if err != nil {
+		log.Printf("info: news_tootsテーブルが更新できませんでした：%s", err)
+	}
+	return
+}
+
+// ownStatusKindは、botの投稿が、短歌を見つけた時の返信か、記事から拾った短歌か、それ以外かを返す。
+func (db DB) ownStatusKind(bot *Persona, statusID mastodon.ID) (kind string, err error) {
+	var n int
+	err = db.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM news_toots WHERE bot_id = ? AND status_id = ?) * 2 +
+			(SELECT COUNT(*) FROM replies WHERE bot_id = ? AND reply_id = ?)`,
+		bot.DBID, string(statusID), bot.DBID, string(statusID),
+	).Scan(&n)
+	if err != nil {
+		log.Printf("info: %s の投稿 %s の種類を取得し損ねました：%s", bot.Name, statusID, err)
+		return
+	}
+	switch {
+	case n >= 2:
+		kind = ownStatusNews
+	case n == 1:
+		kind = ownStatusReply
+	default:
+		kind = ownStatusOther
+	}
+	return
+}
+
+// addEngagementは、botの投稿へのふぁぼやブーストを記録する。
+// 同じ人の同じ反応は一度だけ数え、その人が初めてbotの投稿に同じ反応をしたのならfirstを返す。
+func (db DB) addEngagement(bot *Persona, statusID mastodon.ID, statusKind, kind, acct string) (first bool, err error) {
+	res, err := db.Exec(`
+		INSERT IGNORE INTO
+			engagements (bot_id, status_id, status_kind, kind, acct, created_at)
+		VALUES
+			(?, ?, ?, ?, ?, ?)`,
+		bot.DBID, string(statusID), statusKind, kind, acct, time.Now(),
+	)
+	if err != nil {
+		log.Printf("info: engagementsテーブルが更新できませんでした：%s", err)
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return
+	}
+
+	var count int
+	if err = db.QueryRow(`
+		SELECT
+			COUNT(*)
+		FROM engagements
+		WHERE bot_id = ? AND kind = ? AND acct = ?`,
+		bot.DBID, kind, acct,
+	).Scan(&count); err != nil {
+		log.Printf("info: engagementsテーブルから %s の反応の数を取得し損ねました：%s", acct, err)
+		return
+	}
+	first = count == 1
+	return
+}
+
+// sourceStatsSinceは、sinceより後に投稿した記事の短歌について、出どころごとの投稿数と反応の数を、反応の多い順に返す。
+func (db DB) sourceStatsSince(bot *Persona, since time.Time, limit int) (stats []sourceStats, err error) {
+	rows, err := db.Query(`
+		SELECT
+			n.source,
+			COUNT(DISTINCT n.status_id),
+			COUNT(CASE WHEN e.kind = 'favourite' THEN 1 END),
+			COUNT(CASE WHEN e.kind = 'reblog' THEN 1 END)
+		FROM
+			news_toots n
+			LEFT JOIN engagements e ON e.bot_id = n.bot_id AND e.status_id = n.status_id
+		WHERE
+			n.bot_id = ? AND n.created_at > ?
+		GROUP BY
+			n.source
+		ORDER BY
+			COUNT(e.status_id) / COUNT(DISTINCT n.status_id) DESC
+		LIMIT ?`,
+		bot.DBID, since, limit,
+	)
+	if err != nil {
+		log.Printf("info: news_tootsテーブルから %s の出どころごとの反応を集め損ねました：%s", bot.Name, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s sourceStats
+		if err := rows.Scan(&s.Source, &s.Toots, &s.Favourites, &s.Reblogs); err != nil {
+			log.Printf("info: news_tootsテーブルから一行の情報取得に失敗しました：%s", err)
+			continue
+		}
+		stats = append(stats, s)
+	}
+	err = rows.Err()
+	return
+}
@@ -7,6 +7,7 @@ import (
 	"runtime"
 	"sort"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	mastodon "github.com/hanage999/go-mastodon"
@@ -23,9 +24,6 @@ type Persona struct {
 	Starter         string
 	Assertion       string
 	ItemPool        int
-	MorningComments []string
-	EveningComments []string
-	Hashtags        []string
 	DBID            int
 	WakeHour        int
 	WakeMin         int
@@ -37,10 +35,65 @@ type Persona struct {
 	PlaceName       string
 	TimeZone        string
 	RandomFrequency int
+	ContestHashtag  string
+	ContestDays     int
+	ContestWinners  int
+	StreamingMode   string
+	PollingMinSec   int
+	PollingMaxSec   int
+	EventWorkers    int
+	EventQueueSize  int
+	ConsentCacheMin int
+	FollowSyncHours int
 	Awake           time.Duration
+	streams         map[string]*streamState
+	backfillLock    chan int
+	replyLock       chan int
+	events          *eventQueue
+	consent         *consentCache
+	blocks          *blockList
+	ctl             *control
+	live            *atomic.Pointer[settings]
 	*commonSettings
 }
 
+// settings は、動いているbotに設定再読込で反映できる設定を格納する。読み込み直した時は、丸ごと差し替える。
+type settings struct {
+	MorningComments          []string
+	EveningComments          []string
+	Hashtags                 []string
+	HyakuninDaily            bool
+	KaeshiutaRate            int
+	KaeshiutaAccounts        []string
+	BackfillMaxHours         int
+	BackfillMaxReplies       int
+	OptOutMarkers            []string
+	ReplyToBots              bool
+	RepliesPerHour           int
+	RepliesPerDay            int
+	GlobalRepliesPerHour     int
+	ReplyCooldownMin         int
+	ReplyPolicy              string
+	Admins                   []string
+	FollowRequestRule        string
+	FollowRequestMinAgeDays  int
+	FollowRequestDenyDomains []string
+	FollowSyncMaxChanges     int
+	UnfollowNonFollowers     bool
+	DormantDays              int
+	BlockedAccounts          []string
+	BlockedDomains           []string
+	BlockedKeywords          []string
+	NGWords                  []string
+	QuietWords               []string
+	ReblogThanks             string
+}
+
+// cfg は、いま有効な設定を返す。
+func (bot *Persona) cfg() *settings {
+	return bot.live.Load()
+}
+
 // getMastoID はbotのMastodonアカウントIDを取得する。
 func (bot *Persona) getMastoID() (err error) {
 	ctx := context.Background()
@@ -121,40 +174,58 @@ func (bot *Persona) daylife(ctx context.Context, db DB, sleep time.Duration, act
 		defer t.Stop()
 		if !firstLaunch && !nextDayOfPolarNight {
 			go func() {
-				idx := rand.Intn(len(bot.EveningComments))
-				msg := bot.EveningComments[idx]
+				idx := rand.Intn(len(bot.cfg().EveningComments))
+				msg := bot.cfg().EveningComments[idx]
 				toot := mastodon.Toot{Status: msg + sleepWithSun + "今宵はこれにて💤……"}
 				if err := bot.post(ctx, toot); err != nil {
 					log.Printf("info: %s がトゥートできませんでした。今回は諦めます……", bot.Name)
 				}
 			}()
 		}
+		wakeAt := time.Now().Add(sleep)
+		// 寝ている間も、管理者の「起床」の指示だけは聞く
+		listenCtx, stopListening := context.WithCancel(ctx)
+		go bot.listenForWake(listenCtx, db)
 	LOOP:
 		for {
 			select {
 			case <-t.C:
 				break LOOP
+			case cmd := <-bot.ctl.cmds:
+				// 起床の指示なら、寝ているはずだった分も活動する
+				if cmd == "wake" {
+					active += time.Until(wakeAt)
+					break LOOP
+				}
 			case <-ctx.Done():
+				stopListening()
 				return
 			}
 		}
+		stopListening()
 	}
 
 	newCtx, cancel := context.WithTimeout(ctx, active)
 	defer cancel()
 
 	if active > 0 {
+		bot.ctl.setAwake(true)
 		log.Printf("info: %s が起きたところ", bot.Name)
 		log.Printf("trace: Goroutines: %d", runtime.NumGoroutine())
 		nextDayOfPolarNight = false
+		bot.forgetProcessed(db)
+		bot.forgetReplyLog(db)
 		bot.activities(newCtx, db)
-		if err := bot.checkNotifications(newCtx); err != nil {
+		if err := bot.checkNotifications(newCtx, db); err != nil {
 			log.Printf("info: %s が通知を遡れませんでした。今回は諦めます……", bot.Name)
 		}
+		if bot.cfg().HyakuninDaily {
+			go bot.hyakuninToot(newCtx)
+		}
 		if sleep > 0 {
 			go func() {
-				idx := rand.Intn(len(bot.MorningComments))
-				msg := bot.MorningComments[idx]
+				idx := rand.Intn(len(bot.cfg().MorningComments))
+				msg := bot.cfg().MorningComments[idx]
 				toot := mastodon.Toot{Status: msg + wakeWithSun + "夜が明けましてござります"}
 				if err := bot.post(newCtx, toot); err != nil {
 					log.Printf("info: %s がトゥートできませんでした。今回は諦めます……", bot.Name)
@@ -165,21 +236,56 @@ func (bot *Persona) daylife(ctx context.Context, db DB, sleep time.Duration, act
 		nextDayOfPolarNight = true
 	}
 
-	<-newCtx.Done()
+	bedtime, _ := newCtx.Deadline()
+	forced := false
+WAIT:
+	for {
+		select {
+		case <-newCtx.Done():
+			break WAIT
+		case cmd := <-bot.ctl.cmds:
+			// 就寝の指示なら、すぐに寝る
+			if cmd == "sleep" {
+				forced = true
+				cancel()
+				break WAIT
+			}
+		}
+	}
+	bot.ctl.setAwake(false)
+	if active > 0 && ctx.Err() == nil {
+		bot.postDigest(ctx, db)
+	}
 	log.Printf("info: %s が寝たところ", bot.Name)
 	log.Printf("trace: Goroutines: %d", runtime.NumGoroutine())
 	if ctx.Err() == nil {
+		if forced {
+			// いつもの就寝時刻までは、起床の指示を待ちながら寝る
+			go bot.daylife(ctx, db, time.Until(bedtime), 0, false, false)
+			return
+		}
 		bot.spawn(ctx, db, false, nextDayOfPolarNight)
 	}
 }
 
 // activities は、botの活動の全てを実行する
 func (bot *Persona) activities(ctx context.Context, db DB) {
-	go bot.monitor(ctx)
+	bot.loadBlocks(ctx, db)
+	bot.startWorkers(ctx, db)
+	go bot.monitor(ctx, db)
 	go bot.randomToot(ctx, db)
+	go bot.harvestStock(db)
+	go bot.checkReplies(ctx, db)
+	if bot.FollowSyncHours > 0 {
+		go bot.syncFollows(ctx, db)
+	}
+	if bot.ContestHashtag != "" {
+		go bot.monitorContest(ctx, db)
+		go bot.contestTimer(ctx, db)
+	}
 }
 
-func (bot *Persona) checkNotifications(ctx context.Context) (err error) {
+func (bot *Persona) checkNotifications(ctx context.Context, db DB) (err error) {
 	ns, err := bot.notifications(ctx)
 	if err != nil {
 		log.Printf("info: %s が通知一覧を取得できませんでした：%s", bot.Name, err)
@@ -189,24 +295,7 @@ func (bot *Persona) checkNotifications(ctx context.Context) (err error) {
 	sort.Sort(ns)
 
 	for _, n := range ns {
-		switch n.Type {
-		case "mention":
-			if err = bot.respondToMention(ctx, n.Account, n.Status); err != nil {
-				log.Printf("info: %s がメンションに反応できませんでした：%s", bot.Name, err)
-				return
-			}
-		case "reblog":
-			// TODO
-		case "favourite":
-			// TODO
-		case "follow":
-			if err = bot.respondToFollow(ctx, n.Account); err != nil {
-				log.Printf("info: %s がフォローに反応できませんでした：%s", bot.Name, err)
-				return
-			}
-		}
-		if err = bot.dismissNotification(ctx, n.ID); err != nil {
-			log.Printf("info: %s が id:%s の通知を削除できませんでした：%s", bot.Name, string(n.ID), err)
+		if err = bot.respondToNotification(ctx, db, &mastodon.NotificationEvent{Notification: n}); err != nil {
 			return
 		}
 	}
@@ -248,9 +337,15 @@ func (bot *Persona) fav(ctx context.Context, id mastodon.ID) (err error) {
 
 // post は投稿する。失敗したらmaxRetryを上限に再試行する。
 func (bot *Persona) post(ctx context.Context, toot mastodon.Toot) (err error) {
+	_, err = bot.postStatus(ctx, toot)
+	return
+}
+
+// postStatus は投稿して、投稿されたステータスを返す。失敗したらmaxRetryを上限に再試行する。
+func (bot *Persona) postStatus(ctx context.Context, toot mastodon.Toot) (status *mastodon.Status, err error) {
 	time.Sleep(time.Duration(rand.Intn(5000)+3000) * time.Millisecond)
 	for i := 0; i < bot.commonSettings.maxRetry; i++ {
-		_, err = bot.Client.PostStatus(ctx, &toot)
+		status, err = bot.Client.PostStatus(ctx, &toot)
 		if err == nil {
 			return
 		}
@@ -262,6 +357,36 @@ func (bot *Persona) post(ctx context.Context, toot mastodon.Toot) (err error) {
 	return
 }
 
+// editStatus は、botの投稿を編集する。失敗したらmaxRetryを上限に再試行する。既に削除されていたら諦める。
+func (bot *Persona) editStatus(ctx context.Context, id mastodon.ID, toot mastodon.Toot) (err error) {
+	for i := 0; i < bot.commonSettings.maxRetry; i++ {
+		_, err = bot.Client.UpdateStatus(ctx, &toot, id)
+		if err == nil || notFound(err) {
+			return
+		}
+		log.Printf("info: %s が id:%s のトゥートを編集できません：%s", bot.Name, string(id), err)
+		time.Sleep(bot.commonSettings.retryInterval)
+	}
+
+	log.Printf("info: %s の id:%s のトゥート編集がリトライ上限に達しました：%s", bot.Name, string(id), err)
+	return
+}
+
+// deleteStatus は、botの投稿を削除する。失敗したらmaxRetryを上限に再試行する。既に削除されていたら諦める。
+func (bot *Persona) deleteStatus(ctx context.Context, id mastodon.ID) (err error) {
+	for i := 0; i < bot.commonSettings.maxRetry; i++ {
+		err = bot.Client.DeleteStatus(ctx, id)
+		if err == nil || notFound(err) {
+			return
+		}
+		log.Printf("info: %s が id:%s のトゥートを削除できません：%s", bot.Name, string(id), err)
+		time.Sleep(bot.commonSettings.retryInterval)
+	}
+
+	log.Printf("info: %s の id:%s のトゥート削除がリトライ上限に達しました：%s", bot.Name, string(id), err)
+	return
+}
+
 // follow はアカウントをフォローする。失敗したらmaxRetryを上限に再試行する。
 func (bot *Persona) follow(ctx context.Context, id mastodon.ID) (err error) {
 	time.Sleep(time.Duration(rand.Intn(2000)+1000) * time.Millisecond)
@@ -309,6 +434,25 @@ func (bot *Persona) relationWith(ctx context.Context, id mastodon.ID) (rel []*ma
 	return
 }
 
+// getStatus はステータスを取得する。失敗したらmaxRetryを上限に再試行する。削除されたか見えないステータスなら諦める。
+func (bot *Persona) getStatus(ctx context.Context, id mastodon.ID) (status *mastodon.Status, err error) {
+	for i := 0; i < bot.commonSettings.maxRetry; i++ {
+		status, err = bot.Client.GetStatus(ctx, id)
+		if err == nil {
+			return
+		}
+		if notFound(err) {
+			log.Printf("info: %s には id:%s のステータスが見つかりません", bot.Name, string(id))
+			return
+		}
+		log.Printf("info: %s が id:%s のステータスを取得できません：%s", bot.Name, string(id), err)
+		time.Sleep(bot.commonSettings.retryInterval)
+	}
+
+	log.Printf("info: %s の id:%s のステータス取得がリトライ上限に達しました：%s", bot.Name, string(id), err)
+	return
+}
+
 func (bot *Persona) notifications(ctx context.Context) (ns Notifications, err error) {
 	var pg mastodon.Pagination
 	for i := 0; i < bot.commonSettings.maxRetry; i++ {
@@ -0,0 +1,236 @@
+package tankabot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// control は、管理者のコマンドで動いているbotを操るための状態を格納する。
+type control struct {
+	startedAt time.Time
+	paused    int32
+	awake     int32
+	cmds      chan string // cmds は、daylifeへの就寝（sleep）・起床（wake）の指示。
+}
+
+func newControl() *control {
+	return &control{startedAt: time.Now(), cmds: make(chan string, 1)}
+}
+
+func (c *control) isPaused() bool {
+	return atomic.LoadInt32(&c.paused) == 1
+}
+
+func (c *control) setPaused(p bool) {
+	v := int32(0)
+	if p {
+		v = 1
+	}
+	atomic.StoreInt32(&c.paused, v)
+}
+
+func (c *control) isAwake() bool {
+	return atomic.LoadInt32(&c.awake) == 1
+}
+
+func (c *control) setAwake(a bool) {
+	v := int32(0)
+	if a {
+		v = 1
+	}
+	atomic.StoreInt32(&c.awake, v)
+}
+
+// order は、daylifeに就寝か起床を指示する。前の指示が届いていなければ、新しい指示は捨てる。
+func (c *control) order(cmd string) bool {
+	select {
+	case c.cmds <- cmd:
+		return true
+	default:
+		return false
+	}
+}
+
+// wakeListenInterval は、寝ている間に管理者の「起床」の指示を確かめる間隔。
+const wakeListenInterval = time.Minute
+
+// listenForWake は、寝ている間、管理者からの「起床」のメンションだけを定期的に確かめて、daylifeに起床を指示する。
+// ほかの通知には触れずに残しておき、起きた時のcheckNotificationsに任せる。
+func (bot *Persona) listenForWake(ctx context.Context, db DB) {
+	t := time.NewTicker(wakeListenInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+
+		ns, err := bot.Client.GetNotifications(ctx, &mastodon.Pagination{Limit: 40})
+		if err != nil {
+			log.Printf("info: %s が寝ている間に通知を確かめられませんでした：%s", bot.Name, err)
+			continue
+		}
+		for _, n := range ns {
+			if n.Type != "mention" || n.Status == nil || !bot.isAdmin(n.Account) {
+				continue
+			}
+			req := bot.findCommand(n.Account, n.Status)
+			if req == nil || req.Command.Name != "起床" || !bot.claim(db, "notification", n.ID) {
+				continue
+			}
+			if err := bot.runCommand(ctx, db, req); err != nil {
+				bot.unclaim(db, "notification", n.ID)
+				continue
+			}
+			if err := bot.dismissNotification(ctx, n.ID); err != nil {
+				log.Printf("info: %s が id:%s の通知を削除できませんでした：%s", bot.Name, string(n.ID), err)
+			}
+			return
+		}
+	}
+}
+
+// adminCommands は、管理者がメンションかDMで送る、botを操るコマンド。
+var adminCommands = map[string]func(bot *Persona, ctx context.Context, db DB) string{
+	"一時停止": func(bot *Persona, ctx context.Context, db DB) string {
+		bot.ctl.setPaused(true)
+		return "一時停止しました。管理者のコマンドにだけ応えます。「再開」で元に戻ります"
+	},
+	"再開": func(bot *Persona, ctx context.Context, db DB) string {
+		// 一時停止中の投稿は見たことにしていないので、新しい投稿で見た位置が進む前に、遡りの起点を控えておく
+		since, err := db.lastStatusID(bot)
+		bot.ctl.setPaused(false)
+		if err != nil || since == "" {
+			return "再開しました（一時停止中の投稿は遡れませんでした）"
+		}
+		go bot.backfillFrom(ctx, db, since)
+		return "再開しました。一時停止中の投稿も遡って短歌を探します"
+	},
+	"状態": func(bot *Persona, ctx context.Context, db DB) string {
+		return bot.statusReport(db)
+	},
+	"設定再読込": func(bot *Persona, ctx context.Context, db DB) string {
+		if err := bot.reloadConfig(ctx, db); err != nil {
+			return "設定ファイルを読み込めませんでした：" + err.Error()
+		}
+		return "設定を読み込み直しました（インスタンス・アクセストークン・寝起きの時刻・監視方法・ワーカー数などは、再起動で反映されます）"
+	},
+	"今すぐ投稿": func(bot *Persona, ctx context.Context, db DB) string {
+		if err := bot.newsTootNow(ctx, db); err != nil {
+			return "投稿できませんでした：" + err.Error()
+		}
+		return "ネットの記事から一首投稿しました"
+	},
+	"就寝": func(bot *Persona, ctx context.Context, db DB) string {
+		if !bot.ctl.isAwake() {
+			return "もう寝ています"
+		}
+		if !bot.ctl.order("sleep") {
+			return "前の指示を処理中です"
+		}
+		return "寝ます。いつもの起床時刻か「起床」の指示で起きます"
+	},
+	"起床": func(bot *Persona, ctx context.Context, db DB) string {
+		if bot.ctl.isAwake() {
+			return "もう起きています"
+		}
+		if !bot.ctl.order("wake") {
+			return "前の指示を処理中です"
+		}
+		return "起きます。いつもの就寝時刻まで活動します"
+	},
+}
+
+// runAdminCommand は、管理者のコマンドを実行して、結果をDMで返信する。
+func (bot *Persona) runAdminCommand(ctx context.Context, db DB, cmd string, account mastodon.Account, status *mastodon.Status) (err error) {
+	log.Printf("info: %s が %s のコマンド「%s」を実行します", bot.Name, account.Acct, cmd)
+	msg := "@" + account.Acct + " " + adminCommands[cmd](bot, ctx, db)
+
+	toot := mastodon.Toot{Status: msg, Visibility: "direct", InReplyToID: status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s がコマンドの結果を返信できませんでした", bot.Name)
+	}
+	return
+}
+
+// statusReport は、botの今の状態を文章にする。
+func (bot *Persona) statusReport(db DB) string {
+	lines := make([]string, 0)
+	lines = append(lines, "稼働時間："+time.Since(bot.ctl.startedAt).Round(time.Minute).String())
+
+	state := "寝ています"
+	if bot.ctl.isAwake() {
+		state = "起きています"
+	}
+	if bot.ctl.isPaused() {
+		state += "（一時停止中）"
+	}
+	lines = append(lines, "状態："+state)
+
+	q := bot.QueueStats()
+	lines = append(lines, fmt.Sprintf("処理待ち：投稿%d・通知%d（あふれて捨てたもの：投稿%d・通知%d）", q.Updates, q.Notifications, q.DroppedUpdates, q.DroppedNotifications))
+
+	if n, err := db.stockCount(bot); err == nil {
+		lines = append(lines, fmt.Sprintf("投稿候補のストック：%d件", n))
+	}
+
+	if stats, err := db.sourceStatsSince(bot, time.Now().AddDate(0, 0, -30), 3); err == nil && len(stats) > 0 {
+		lines = append(lines, "この30日によく反応された記事の出どころ：")
+		for _, s := range stats {
+			lines = append(lines, fmt.Sprintf("・%s：%d首、ふぁぼ%d・ブースト%d", s.Source, s.Toots, s.Favourites, s.Reblogs))
+		}
+	}
+
+	for _, s := range bot.StreamStatuses() {
+		if s.Since.IsZero() {
+			continue
+		}
+		conn := "切断"
+		if s.Connected {
+			conn = "接続中"
+		}
+		lines = append(lines, fmt.Sprintf("%s：%s（再接続%d回）", s.Name, conn, s.Reconnects))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reloadConfig は、設定ファイルを読み込み直して、再起動しなくても変えられる設定だけを反映する。
+func (bot *Persona) reloadConfig(ctx context.Context, db DB) (err error) {
+	conf, err := readConfig()
+	if err != nil {
+		return
+	}
+	fresh, err := readSettings(conf)
+	if err != nil {
+		return
+	}
+
+	// 設定を読んでいるゴルーチンが途中で食い違った設定を見ないように、丸ごと一度に差し替える
+	bot.live.Store(fresh)
+	bot.loadBlocks(ctx, db)
+
+	log.Printf("info: %s が設定を読み込み直しました", bot.Name)
+	return
+}
+
+// newsTootNow は、たまった候補からすぐに一首投稿する。
+func (bot *Persona) newsTootNow(ctx context.Context, db DB) (err error) {
+	if _, err = db.stockItems(bot); err != nil {
+		return
+	}
+	toot, item, err := bot.createSongNewsToot(db)
+	if err != nil {
+		return
+	}
+	if item.Title == "" || toot.Status == "" {
+		return fmt.Errorf("投稿候補がありません")
+	}
+	return bot.postNews(ctx, db, toot, item)
+}
@@ -0,0 +1,78 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// backfill は、最後に見たステータス以降のホームタイムラインを古い順に遡って短歌を探す。
+// BackfillMaxHoursより古い投稿は飛ばし、返信がBackfillMaxRepliesに達したら残りは見たことにするだけにする。
+func (bot *Persona) backfill(ctx context.Context, db DB) {
+	since, err := db.lastStatusID(bot)
+	if err != nil {
+		log.Printf("info: %s が見逃した投稿を遡れませんでした", bot.Name)
+		return
+	}
+	bot.backfillFrom(ctx, db, since)
+}
+
+// backfillFrom は、sinceより後のホームタイムラインを古い順に遡って短歌を探す。
+func (bot *Persona) backfillFrom(ctx context.Context, db DB, since mastodon.ID) {
+	// 同時に遡るのは一つだけ
+	select {
+	case bot.backfillLock <- 0:
+		defer func() { <-bot.backfillLock }()
+	default:
+		return
+	}
+
+	// 初めてなら、今ある最新のものを起点にするだけ
+	if since == "" {
+		ss, err := bot.Client.GetTimelineHome(ctx, &mastodon.Pagination{Limit: 1})
+		if err == nil && len(ss) > 0 {
+			if err := db.setLastStatusID(bot, ss[0].ID); err != nil {
+				log.Printf("info: %s が遡りの起点を記録できませんでした", bot.Name)
+			}
+		}
+		return
+	}
+
+	oldest := time.Now().Add(-time.Duration(bot.cfg().BackfillMaxHours) * time.Hour)
+	seen, replies := 0, 0
+	for ctx.Err() == nil {
+		ss, err := bot.Client.GetTimelineHome(ctx, &mastodon.Pagination{MinID: since, Limit: 40})
+		if err != nil {
+			log.Printf("info: %s がホームタイムラインを遡れませんでした：%s", bot.Name, err)
+			break
+		}
+		if len(ss) == 0 {
+			break
+		}
+
+		for i := len(ss) - 1; i >= 0; i-- {
+			s := ss[i]
+			seen++
+			if replies >= bot.cfg().BackfillMaxReplies || s.CreatedAt.Before(oldest) {
+				if err := db.setLastStatusID(bot, s.ID); err != nil {
+					log.Printf("info: %s が見たステータスを記録できませんでした", bot.Name)
+				}
+				continue
+			}
+			replied, err := bot.respondToStatus(ctx, db, s)
+			if err != nil {
+				log.Printf("info: %s が見逃したトゥートに反応できませんでした", bot.Name)
+			}
+			if replied {
+				replies++
+			}
+		}
+		since = ss[0].ID
+	}
+
+	if seen > 0 {
+		log.Printf("info: %s が見逃した %d 件の投稿を遡り、%d 件に返信しました", bot.Name, seen, replies)
+	}
+}
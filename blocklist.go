@@ -0,0 +1,286 @@
+package tankabot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// blockKinds は、ブロックリストの種類と、管理者のコマンドでの呼び名。
+var blockKinds = map[string]string{
+	"アカウント": "account",
+	"ドメイン":  "domain",
+	"キーワード": "keyword",
+}
+
+// nextLinkRegexp は、Linkヘッダーから次のページのmax_idを取り出す。
+var nextLinkRegexp = regexp.MustCompile(`[?&]max_id=(\w+)[^>]*>;\s*rel="next"`)
+
+// blockEntry は、ブロックリストの一項目を格納する。Sourceは、config（設定ファイル）、admin（管理者のコマンド）、server（サーバー側のブロック）のどれか。
+type blockEntry struct {
+	Kind   string
+	Value  string
+	Source string
+}
+
+// blockList は、関わらないアカウント・ドメイン・キーワードを格納する。
+type blockList struct {
+	mu      sync.RWMutex
+	entries map[string]map[string]string // entries は、種類ごとに、値から出どころを引く。
+}
+
+func newBlockList() *blockList {
+	return &blockList{entries: make(map[string]map[string]string)}
+}
+
+// normalizeBlock は、ブロックリストの値を比較用にそろえる。
+func normalizeBlock(kind, value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if kind == "account" {
+		value = strings.TrimPrefix(value, "@")
+	}
+	return value
+}
+
+// replace は、ブロックリストを丸ごと入れ替える。
+func (b *blockList) replace(entries []blockEntry) {
+	m := make(map[string]map[string]string)
+	for _, e := range entries {
+		if m[e.Kind] == nil {
+			m[e.Kind] = make(map[string]string)
+		}
+		if v := normalizeBlock(e.Kind, e.Value); v != "" {
+			m[e.Kind][v] = e.Source
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries = m
+}
+
+func (b *blockList) add(e blockEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.entries[e.Kind] == nil {
+		b.entries[e.Kind] = make(map[string]string)
+	}
+	b.entries[e.Kind][normalizeBlock(e.Kind, e.Value)] = e.Source
+}
+
+func (b *blockList) remove(kind, value string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.entries[kind], normalizeBlock(kind, value))
+}
+
+// matches は、アカウントか、そのドメイン（親ドメインを含む）か、文章のキーワードがブロックリストにあれば、その項目を返す。
+func (b *blockList) matches(acct, text string) (e blockEntry, found bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	acct = normalizeBlock("account", acct)
+	if src, ok := b.entries["account"][acct]; ok {
+		return blockEntry{"account", acct, src}, true
+	}
+	for d := domainOf(acct); d != ""; {
+		if src, ok := b.entries["domain"][d]; ok {
+			return blockEntry{"domain", d, src}, true
+		}
+		i := strings.Index(d, ".")
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	text = strings.ToLower(text)
+	for kw, src := range b.entries["keyword"] {
+		if text != "" && strings.Contains(text, kw) {
+			return blockEntry{"keyword", kw, src}, true
+		}
+	}
+	return
+}
+
+// list は、ブロックリストの項目を種類と値の順に返す。
+func (b *blockList) list() (entries []blockEntry) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for kind, vs := range b.entries {
+		for v, src := range vs {
+			entries = append(entries, blockEntry{kind, v, src})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Kind != entries[j].Kind {
+			return entries[i].Kind < entries[j].Kind
+		}
+		return entries[i].Value < entries[j].Value
+	})
+	return
+}
+
+// blocked は、アカウントか文章がブロックリストに当たるかどうかを返す。
+func (bot *Persona) blocked(account mastodon.Account, text string) bool {
+	e, found := bot.blocks.matches(account.Acct, text)
+	if found {
+		log.Printf("trace: %s が %s をブロックリスト（%s:%s）により無視しました", bot.Name, account.Acct, e.Kind, e.Value)
+	}
+	return found
+}
+
+// loadBlocks は、設定ファイルとDBのブロックリストを読み込む。サーバー側のブロックも取り込んでDBに保存する。
+// 同期はサーバーからの取り込みだけで、設定ファイルや管理者のコマンドで加えた項目を、サーバー側のブロックにはしない。
+func (bot *Persona) loadBlocks(ctx context.Context, db DB) {
+	if server, err := bot.serverBlocks(ctx); err == nil {
+		if err := db.replaceBlocks(bot, "server", server); err != nil {
+			log.Printf("info: %s がサーバー側のブロックを保存できませんでした", bot.Name)
+		}
+	}
+
+	entries := make([]blockEntry, 0)
+	for kind, vs := range map[string][]string{"account": bot.cfg().BlockedAccounts, "domain": bot.cfg().BlockedDomains, "keyword": bot.cfg().BlockedKeywords} {
+		for _, v := range vs {
+			entries = append(entries, blockEntry{kind, v, "config"})
+		}
+	}
+	stored, err := db.blocks(bot)
+	if err != nil {
+		log.Printf("info: %s がブロックリストを読み込めませんでした", bot.Name)
+	}
+	bot.blocks.replace(append(stored, entries...))
+}
+
+// serverBlocks は、botのアカウントがサーバー側でブロックしているアカウントとドメインを取得する。
+func (bot *Persona) serverBlocks(ctx context.Context) (entries []blockEntry, err error) {
+	pg := mastodon.Pagination{Limit: followSyncPageLimit}
+	for {
+		accs, err := bot.Client.GetBlocks(ctx, &pg)
+		if err != nil {
+			log.Printf("info: %s がブロック一覧を取得できませんでした：%s", bot.Name, err)
+			return nil, err
+		}
+		for _, a := range accs {
+			entries = append(entries, blockEntry{"account", a.Acct, "server"})
+		}
+		if pg.MaxID == "" || len(accs) == 0 {
+			break
+		}
+		pg = mastodon.Pagination{MaxID: pg.MaxID, Limit: followSyncPageLimit}
+	}
+
+	domains, err := bot.domainBlocks(ctx)
+	if err != nil {
+		return
+	}
+	for _, d := range domains {
+		entries = append(entries, blockEntry{"domain", d, "server"})
+	}
+	return
+}
+
+// domainBlocks は、botのアカウントがブロックしているドメインを取得する。ライブラリにないのでAPIを直接呼ぶ。
+func (bot *Persona) domainBlocks(ctx context.Context) (domains []string, err error) {
+	maxID := ""
+	for {
+		u := strings.TrimSuffix(bot.Instance, "/") + "/api/v1/domain_blocks?limit=200"
+		if maxID != "" {
+			u += "&max_id=" + maxID
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+bot.AccessToken)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("info: %s がドメインブロック一覧を取得できませんでした：%s", bot.Name, err)
+			return nil, err
+		}
+		if code := res.StatusCode; code >= 400 {
+			res.Body.Close()
+			err = fmt.Errorf("ドメインブロック一覧の取得エラーです(%d)", code)
+			log.Printf("info: %s の%s", bot.Name, err)
+			return nil, err
+		}
+		var page []string
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			log.Printf("info: %s がドメインブロック一覧をデコードできませんでした：%s", bot.Name, err)
+			return nil, err
+		}
+		domains = append(domains, page...)
+
+		m := nextLinkRegexp.FindStringSubmatch(res.Header.Get("Link"))
+		if m == nil || len(page) == 0 {
+			return domains, nil
+		}
+		maxID = m[1]
+		time.Sleep(time.Second)
+	}
+}
+
+// editBlocks は、管理者のコマンドに従ってブロックリストに項目を加えるか外し、結果を返信する。
+func (bot *Persona) editBlocks(ctx context.Context, db DB, add bool, req *commandRequest) (err error) {
+	kind, ok := blockKinds[req.Args[0]]
+	if !ok {
+		return req.usage()
+	}
+	account, status := req.Account, req.Status
+	e := blockEntry{Kind: kind, Value: normalizeBlock(kind, req.Args[1]), Source: "admin"}
+
+	msg := "@" + account.Acct + " "
+	if add {
+		if err = db.addBlock(bot, e); err != nil {
+			return
+		}
+		bot.blocks.add(e)
+		msg += req.Args[0] + "「" + e.Value + "」をブロックリストに加えました（botの中だけのブロックです。サーバー側でもブロックするには、botのアカウントで設定してください）"
+	} else {
+		if err = db.deleteBlock(bot, e); err != nil {
+			return
+		}
+		bot.blocks.remove(e.Kind, e.Value)
+		msg += req.Args[0] + "「" + e.Value + "」をブロックリストから外しました（設定ファイルやサーバー側のブロックは、そちらで外してください）"
+	}
+	log.Printf("info: %s のブロックリストを %s が編集しました：%s %s:%s", bot.Name, account.Acct, req.Command.Name, e.Kind, e.Value)
+
+	toot := mastodon.Toot{Status: msg, Visibility: "direct", InReplyToID: status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s がブロックリストの編集結果を返信できませんでした", bot.Name)
+	}
+	return
+}
+
+// listBlocks は、ブロックリストを管理者に返信する。
+func (bot *Persona) listBlocks(ctx context.Context, account mastodon.Account, status *mastodon.Status) (err error) {
+	names := map[string]string{}
+	for name, kind := range blockKinds {
+		names[kind] = name
+	}
+
+	msg := "@" + account.Acct + " ブロックリスト："
+	entries := bot.blocks.list()
+	if len(entries) == 0 {
+		msg += "なし"
+	}
+	for _, e := range entries {
+		msg += "\n" + names[e.Kind] + " " + e.Value + "（" + e.Source + "）"
+	}
+
+	toot := mastodon.Toot{Status: msg, Visibility: "direct", InReplyToID: status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s がブロックリストを返信できませんでした", bot.Name)
+	}
+	return
+}
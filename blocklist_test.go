@@ -0,0 +1,43 @@
+package tankabot
+
+import "testing"
+
+func TestBlockListMatches(t *testing.T) {
+	b := newBlockList()
+	b.replace([]blockEntry{
+		{"account", "@Spammer@example.com", "config"},
+		{"domain", "bad.example", "server"},
+		{"keyword", "宣伝", "admin"},
+	})
+
+	tests := []struct {
+		name string
+		acct string
+		text string
+		want string // want は、当たるはずの項目の値。当たらないはずなら空。
+	}{
+		{"アカウント", "spammer@example.com", "", "spammer@example.com"},
+		{"大文字小文字を区別しない", "SPAMMER@Example.com", "", "spammer@example.com"},
+		{"同じドメインの別の人", "alice@example.com", "", ""},
+		{"ドメイン", "bob@bad.example", "", "bad.example"},
+		{"サブドメイン", "bob@social.bad.example", "", "bad.example"},
+		{"似たドメイン", "bob@notbad.example", "", ""},
+		{"同じインスタンスの人", "carol", "", ""},
+		{"キーワード", "carol", "これは宣伝です", "宣伝"},
+		{"キーワードなし", "carol", "短歌を詠みました", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, found := b.matches(tt.acct, tt.text)
+			if found != (tt.want != "") || e.Value != tt.want {
+				t.Errorf("got (%q, %v), want %q", e.Value, found, tt.want)
+			}
+		})
+	}
+
+	b.remove("keyword", "宣伝")
+	if _, found := b.matches("carol", "これは宣伝です"); found {
+		t.Error("removed keyword still matches")
+	}
+}
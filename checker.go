@@ -0,0 +1,231 @@
+package tankabot
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// songForm は詩型の名前と句ごとの拍数を格納する。
+type songForm struct {
+	name  string
+	morae []int
+}
+
+// songForms は下書きチェックで扱う詩型の一覧。
+var songForms = []songForm{
+	{"短歌", []int{5, 7, 5, 7, 7}},
+	{"俳句", []int{5, 7, 5}},
+	{"片歌", []int{5, 7, 7}},
+	{"旋頭歌", []int{5, 7, 7, 5, 7, 7}},
+}
+
+// kuCheck は一句ぶんのチェック結果を格納する。
+type kuCheck struct {
+	surface string
+	morae   int
+	want    int
+}
+
+// formCheck は下書き全体のチェック結果を格納する。
+type formCheck struct {
+	form songForm
+	kus  []kuCheck
+}
+
+// valid は全ての句が定型どおりかどうかを返す。
+func (fc formCheck) valid() bool {
+	if len(fc.kus) != len(fc.form.morae) {
+		return false
+	}
+	for _, k := range fc.kus {
+		if k.morae != k.want {
+			return false
+		}
+	}
+	return true
+}
+
+// over は定型より多い拍数の合計を返す。
+func (fc formCheck) over() (n int) {
+	for _, k := range fc.kus {
+		if k.morae > k.want {
+			n += k.morae - k.want
+		}
+	}
+	return
+}
+
+// under は定型に足りない拍数の合計を返す。
+func (fc formCheck) under() (n int) {
+	for _, k := range fc.kus {
+		if k.morae < k.want {
+			n += k.want - k.morae
+		}
+	}
+	return
+}
+
+// pattern は詩型を「5-7-5-7-7」のような文字列で返す。
+func (f songForm) pattern() string {
+	ps := make([]string, 0, len(f.morae))
+	for _, m := range f.morae {
+		ps = append(ps, strconv.Itoa(m))
+	}
+	return strings.Join(ps, "-")
+}
+
+// report はチェック結果を返信用の文章にする。
+func (fc formCheck) report() (msg string) {
+	msg = fc.form.name + "（" + fc.form.pattern() + "）として読みました。\n\n"
+	for i, k := range fc.kus {
+		msg += "第" + strconv.Itoa(i+1) + "句「" + k.surface + "」" + strconv.Itoa(k.morae) + "音"
+		switch {
+		case k.want == 0:
+			msg += "（余分な句です）"
+		case k.morae > k.want:
+			msg += "（" + strconv.Itoa(k.morae-k.want) + "音多い：削るか言い換えてみては）"
+		case k.morae < k.want:
+			msg += "（" + strconv.Itoa(k.want-k.morae) + "音足りない：言葉を足してみては）"
+		default:
+			msg += " ✅"
+		}
+		msg += "\n"
+	}
+	for i := len(fc.kus); i < len(fc.form.morae); i++ {
+		msg += "第" + strconv.Itoa(i+1) + "句が見当たりません（" + strconv.Itoa(fc.form.morae[i]) + "音）\n"
+	}
+
+	switch {
+	case fc.valid():
+		msg += "\n定型どおりです！"
+	case len(fc.kus) != len(fc.form.morae):
+		msg += "\n句の数が合いません。句の切れ目に空白か改行を入れてみてください"
+	case fc.under() == 0:
+		msg += "\n字余りです"
+	case fc.over() == 0:
+		msg += "\n字足らずです"
+	default:
+		msg += "\n字余りと字足らずがあります"
+	}
+	return
+}
+
+// checkDraft は下書きの文字列を詩型に当てはめ、句ごとの拍数を調べる。
+// 文中に詩型の名前があればその詩型で、なければ句の数と拍数が最も近い詩型で読む。
+func checkDraft(str string, jpl chan int) (fc formCheck) {
+	forms := songForms
+	for _, f := range songForms {
+		if strings.Contains(str, f.name) {
+			forms = []songForm{f}
+			str = strings.ReplaceAll(str, f.name, "")
+			break
+		}
+	}
+
+	fc = checkAgainst(str, forms, jpl)
+	return
+}
+
+// checkAgainst は下書きの文字列を、与えられた詩型のうち最も近いものに当てはめて調べる。
+func checkAgainst(str string, forms []songForm, jpl chan int) (fc formCheck) {
+	kus := strings.FieldsFunc(str, unicode.IsSpace)
+	if len(kus) == 1 {
+		// 区切りがなければ文節で切り分ける
+		fc = fitPhrases(segmentByPhrase(kus[0], jpl), forms)
+		return
+	}
+
+	checks := make([]kuCheck, 0, len(kus))
+	for _, ku := range kus {
+		checks = append(checks, kuCheck{surface: ku, morae: countMorae(ku, jpl)})
+	}
+
+	fc = closestForm(checks, forms)
+	return
+}
+
+// closestForm は句のチェック結果に最も近い詩型を選び、目標の拍数を書き込む。
+func closestForm(checks []kuCheck, forms []songForm) (fc formCheck) {
+	best := -1
+	for _, f := range forms {
+		d := abs(len(f.morae)-len(checks)) * 100
+		for i, k := range checks {
+			if i < len(f.morae) {
+				d += abs(f.morae[i] - k.morae)
+			}
+		}
+		if best < 0 || d < best {
+			best = d
+			fc.form = f
+		}
+	}
+
+	fc.kus = make([]kuCheck, 0, len(checks))
+	for i, k := range checks {
+		if i < len(fc.form.morae) {
+			k.want = fc.form.morae[i]
+		}
+		fc.kus = append(fc.kus, k)
+	}
+	return
+}
+
+// fitPhrases は区切りのない下書きの文節を、詩型の句に前から順に詰めていく。
+func fitPhrases(phrases []phrase, forms []songForm) (fc formCheck) {
+	total := 0
+	for _, p := range phrases {
+		total += p.moraCount
+	}
+
+	// 総拍数が最も近い詩型を選ぶ
+	best := -1
+	for _, f := range forms {
+		sum := 0
+		for _, m := range f.morae {
+			sum += m
+		}
+		if d := abs(sum - total); best < 0 || d < best {
+			best = d
+			fc.form = f
+		}
+	}
+
+	for _, want := range fc.form.morae {
+		if len(phrases) == 0 {
+			break
+		}
+		k := kuCheck{want: want}
+		for len(phrases) > 0 && k.morae < want {
+			k.surface += phrases[0].surface
+			k.morae += phrases[0].moraCount
+			phrases = phrases[1:]
+		}
+		fc.kus = append(fc.kus, k)
+	}
+
+	// 余った文節は最後の句に含める
+	if len(phrases) > 0 && len(fc.kus) > 0 {
+		last := &fc.kus[len(fc.kus)-1]
+		for _, p := range phrases {
+			last.surface += p.surface
+			last.morae += p.moraCount
+		}
+	}
+	return
+}
+
+// countMorae は文字列の拍数を数える。
+func countMorae(str string, jpl chan int) (count int) {
+	for _, n := range parse(str, jpl) {
+		count += n.moraCount
+	}
+	return
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,65 @@
+package tankabot
+
+import (
+	_ "embed" // for go:embed
+	"strconv"
+	"strings"
+)
+
+// classicPoem は、古典和歌一首を格納する。
+type classicPoem struct {
+	Anthology string
+	Number    int
+	Author    string
+	Kami      string // Kami は上の句。
+	Shimo     string // Shimo は下の句。
+	KamiKana  string
+	ShimoKana string
+}
+
+//go:embed classics/hyakunin.tsv
+var hyakuninTSV string
+
+//go:embed classics/kokinshu.tsv
+var kokinshuTSV string
+
+//go:embed classics/shinkokinshu.tsv
+var shinkokinshuTSV string
+
+// hyakunin は、小倉百人一首の百首。
+var hyakunin = parseClassics("小倉百人一首", hyakuninTSV)
+
+// classicCorpus は、本歌取りの判定に使う古典和歌の全て。
+var classicCorpus = append(append(append([]classicPoem{},
+	hyakunin...),
+	parseClassics("古今和歌集", kokinshuTSV)...),
+	parseClassics("新古今和歌集", shinkokinshuTSV)...)
+
+// parseClassics は、「番号・作者・上の句・下の句・上の句の仮名・下の句の仮名」をタブで区切ったデータを読み込む。
+func parseClassics(anthology, tsv string) (poems []classicPoem) {
+	for _, line := range strings.Split(tsv, "\n") {
+		cols := strings.Split(line, "\t")
+		if len(cols) != 6 {
+			continue
+		}
+		n, err := strconv.Atoi(cols[0])
+		if err != nil {
+			continue
+		}
+		poems = append(poems, classicPoem{
+			Anthology: anthology,
+			Number:    n,
+			Author:    cols[1],
+			Kami:      cols[2],
+			Shimo:     cols[3],
+			KamiKana:  cols[4],
+			ShimoKana: cols[5],
+		})
+	}
+	return
+}
+
+// title は、「小倉百人一首 第1番 天智天皇」のような出典の表記を返す。
+func (p classicPoem) title() string {
+	return p.Anthology + " 第" + strconv.Itoa(p.Number) + "番 " + p.Author
+}
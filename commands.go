@@ -0,0 +1,348 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strings"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// コマンドを使える人の範囲
+const (
+	permEveryone = iota // 誰でも
+	permAdmin           // 管理者だけ
+)
+
+// mentionCommand は、メンションやDMで受け付けるコマンド。
+type mentionCommand struct {
+	Name     string
+	Aliases  []string
+	Args     string // Args は、ヘルプに載せる引数の書き方。
+	MinArgs  int
+	Exact    bool // Exact がtrueなら、本文がコマンドの言葉だけの時に実行する。
+	Anywhere bool // Anywhere がtrueなら、本文の途中に出てきてもコマンドとみなす。
+	Perm     int
+	Help     string
+	Run      func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error
+}
+
+// commandRequest は、コマンドを送ってきた相手と、コマンドの引数を格納する。
+type commandRequest struct {
+	Command *mentionCommand
+	Account mastodon.Account
+	Status  *mastodon.Status
+	Args    []string // Args は、コマンドの言葉に続く、空白で区切られた語。
+}
+
+// commandError は、コマンドを送ってきた相手にそのまま伝える誤り。
+type commandError string
+
+func (e commandError) Error() string {
+	return string(e)
+}
+
+// usage は、コマンドの使い方を伝える誤りを返す。
+func (req *commandRequest) usage() error {
+	return commandError("使い方：「" + strings.TrimSpace(req.Command.Name+" "+req.Command.Args) + "」")
+}
+
+// leadingMentionsRegexp は、本文の先頭に並んだ宛先のメンションにマッチする。
+var leadingMentionsRegexp = regexp.MustCompile(`^(\s*@[A-Za-z0-9_]+(@[A-Za-z0-9.\-]+)?)+`)
+
+// mentionCommands は、botが受け付けるコマンドの一覧。ヘルプはこの順に並べる。
+var mentionCommands []*mentionCommand
+
+func init() {
+	for i, c := range prefCommands {
+		i := i
+		mentionCommands = append(mentionCommands, &mentionCommand{
+			Name: c.word,
+			Perm: permEveryone,
+			Help: c.help,
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				return bot.setPrefs(ctx, db, i, req.Account, req.Status)
+			},
+		})
+	}
+
+	mentionCommands = append(mentionCommands,
+		&mentionCommand{
+			Name: "フォロー解除",
+			// 「すみません、フォロー解除お願いします」のような頼み方でも、確実に聞き入れる
+			Anywhere: true,
+			Perm:     permEveryone,
+			Help:     "フォローを解除します",
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				rel, err := bot.relationWith(ctx, req.Account.ID)
+				if err != nil {
+					log.Printf("info: %s が関係取得に失敗しました", bot.Name)
+					return err
+				}
+				if (*rel[0]).Following {
+					if err = bot.unfollow(ctx, req.Account.ID); err != nil {
+						log.Printf("info: %s がアンフォローに失敗しました", bot.Name)
+						return err
+					}
+				}
+				// フォロー関係の見直しで、またフォローバックしないように覚えておく
+				return db.setUnfollowed(bot, req.Account.Acct, unfollowRequested)
+			},
+		},
+		&mentionCommand{
+			Name: "詠んで",
+			Perm: permEveryone,
+			Help: "誰かの投稿へのリプライで送ると、リプライ先の投稿から短歌を探します",
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				if inReplyTo(req.Status) == "" {
+					return commandError("詠んでほしい投稿へのリプライで「詠んで」とメンションしてください")
+				}
+				return bot.analyzeReferenced(ctx, db, req.Account, req.Status)
+			},
+		},
+		&mentionCommand{
+			Name: "連歌",
+			Args: "五七五の発句",
+			Perm: permEveryone,
+			Help: "続けて発句を書くと連歌を始めます",
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				return bot.startRenga(ctx, db, req.Account, req.Status)
+			},
+		},
+		&mentionCommand{
+			Name: "かるた",
+			Perm: permEveryone,
+			Help: "小倉百人一首の上の句を出題します",
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				return bot.startKaruta(ctx, db, req.Account, req.Status)
+			},
+		},
+		&mentionCommand{
+			Name:    "かるたの成績",
+			Aliases: []string{"かるた成績"},
+			Perm:    permEveryone,
+			Help:    "かるたの通算成績を返します",
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				return bot.replyKarutaScore(ctx, db, req.Account, req.Status)
+			},
+		},
+		&mentionCommand{
+			Name:    "ヘルプ",
+			Aliases: []string{"使い方", "コマンド一覧", "help"},
+			Perm:    permEveryone,
+			Help:    "この一覧を返します",
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				return bot.replyHelp(ctx, req.Account, req.Status)
+			},
+		},
+	)
+
+	for _, c := range []struct{ name, help string }{
+		{"一時停止", "管理者のコマンドにだけ応えるようにします"},
+		{"再開", "一時停止から戻ります"},
+		{"状態", "稼働時間・寝起き・処理待ちの数・ストック数・接続状況を返します"},
+		{"設定再読込", "設定ファイルを読み込み直します"},
+		{"今すぐ投稿", "ネットの記事から一首投稿します"},
+		{"就寝", "いつもの時刻を待たずに寝ます"},
+		{"起床", "いつもの時刻を待たずに起きます"},
+	} {
+		name := c.name
+		mentionCommands = append(mentionCommands, &mentionCommand{
+			Name:  name,
+			Exact: true,
+			Perm:  permAdmin,
+			Help:  c.help,
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				return bot.runAdminCommand(ctx, db, name, req.Account, req.Status)
+			},
+		})
+	}
+
+	mentionCommands = append(mentionCommands,
+		&mentionCommand{
+			Name:    "承認",
+			Args:    "user@domain",
+			MinArgs: 1,
+			Perm:    permAdmin,
+			Help:    "フォローリクエストを承認します",
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				return bot.decideFollowRequest(ctx, db, true, req.Args[0], req.Account, req.Status)
+			},
+		},
+		&mentionCommand{
+			Name:    "拒否",
+			Args:    "user@domain",
+			MinArgs: 1,
+			Perm:    permAdmin,
+			Help:    "フォローリクエストを拒否します",
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				return bot.decideFollowRequest(ctx, db, false, req.Args[0], req.Account, req.Status)
+			},
+		},
+		&mentionCommand{
+			Name: "フォローリクエスト",
+			Perm: permAdmin,
+			Help: "承認待ちのフォローリクエストの一覧を返します",
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				return bot.listFollowRequests(ctx, db, req.Account, req.Status)
+			},
+		},
+		&mentionCommand{
+			Name:    "ブロック追加",
+			Args:    "アカウント|ドメイン|キーワード 値",
+			MinArgs: 2,
+			Perm:    permAdmin,
+			Help:    "ブロックリストに加えます",
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				return bot.editBlocks(ctx, db, true, req)
+			},
+		},
+		&mentionCommand{
+			Name:    "ブロック解除",
+			Args:    "アカウント|ドメイン|キーワード 値",
+			MinArgs: 2,
+			Perm:    permAdmin,
+			Help:    "ブロックリストから外します",
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				return bot.editBlocks(ctx, db, false, req)
+			},
+		},
+		&mentionCommand{
+			Name: "ブロック一覧",
+			Perm: permAdmin,
+			Help: "ブロックリストを返します",
+			Run: func(bot *Persona, ctx context.Context, db DB, req *commandRequest) error {
+				return bot.listBlocks(ctx, req.Account, req.Status)
+			},
+		},
+	)
+}
+
+// permitted は、アカウントがコマンドを使えるかどうかを返す。
+func (bot *Persona) permitted(c *mentionCommand, account mastodon.Account) bool {
+	return c.Perm == permEveryone || bot.isAdmin(account)
+}
+
+// findCommand は、メンションを除いた本文がアカウントの使えるコマンドで始まっていれば、リクエストにして返す。
+// 本文の途中に出てくる言葉は、Anywhereのコマンドを除いてコマンドとみなさない。当てはまるコマンドがいくつもあれば、長い言葉の方を選ぶ（「短歌通知再開」と「再開」など）。
+func (bot *Persona) findCommand(account mastodon.Account, status *mastodon.Status) (req *commandRequest) {
+	content := textContent(status.Content)
+	head := stripMentions(content)
+	// 引数には、「承認 @user@domain」のようにメンションの形で書かれたものもあるので、先頭の宛先だけを除いた本文から取る
+	txt := strings.TrimSpace(leadingMentionsRegexp.ReplaceAllString(content, ""))
+
+	length := 0
+	for _, c := range mentionCommands {
+		if !bot.permitted(c, account) {
+			continue
+		}
+		for _, word := range append([]string{c.Name}, c.Aliases...) {
+			if len(word) <= length || (c.Exact && head != word) {
+				continue
+			}
+			rest := ""
+			switch {
+			case strings.HasPrefix(head, word) && strings.HasPrefix(txt, word):
+				rest = txt[len(word):]
+			case c.Anywhere && strings.Contains(head, word):
+				if i := strings.Index(txt, word); i >= 0 {
+					rest = txt[i+len(word):]
+				}
+			default:
+				continue
+			}
+			length = len(word)
+			req = &commandRequest{
+				Command: c,
+				Account: account,
+				Status:  status,
+				Args:    strings.Fields(rest),
+			}
+		}
+	}
+	return
+}
+
+// runCommand は、コマンドを実行する。引数が足りなかったり、実行できなかったりした時は、そのことをDMで返信する。
+func (bot *Persona) runCommand(ctx context.Context, db DB, req *commandRequest) (err error) {
+	if len(req.Args) < req.Command.MinArgs {
+		return bot.replyCommandError(ctx, req, req.usage())
+	}
+
+	if err = req.Command.Run(bot, ctx, db, req); err != nil {
+		log.Printf("info: %s が %s のコマンド「%s」を実行できませんでした：%s", bot.Name, req.Account.Acct, req.Command.Name, err)
+		if e := bot.replyCommandError(ctx, req, err); e != nil {
+			return e
+		}
+		if _, ok := err.(commandError); ok {
+			return nil
+		}
+	}
+	return
+}
+
+// replyCommandError は、コマンドの誤りをDMで返信する。相手に伝えるべき誤りでなければ、中身には触れずにお詫びする。
+func (bot *Persona) replyCommandError(ctx context.Context, req *commandRequest, cmdErr error) (err error) {
+	msg := "「" + req.Command.Name + "」を処理できませんでした。しばらくしてからもう一度お試しください🙇"
+	if e, ok := cmdErr.(commandError); ok {
+		msg = string(e)
+	}
+
+	toot := mastodon.Toot{Status: "@" + req.Account.Acct + " " + msg, Visibility: "direct", InReplyToID: req.Status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s がコマンドの誤りを返信できませんでした", bot.Name)
+	}
+	return
+}
+
+// replyUnknown は、わからないメンションに、ヘルプの使い方を添えてDMで返信する。
+func (bot *Persona) replyUnknown(ctx context.Context, account mastodon.Account, status *mastodon.Status) (err error) {
+	msg := "@" + account.Acct + " ごめんなさい、わかりませんでした🙇 「ヘルプ」とメンションすると、わかる言葉の一覧をお返しします"
+
+	toot := mastodon.Toot{Status: msg, Visibility: "direct", InReplyToID: status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s がわからないメンションに返信できませんでした", bot.Name)
+	}
+	return
+}
+
+// replyHelp は、アカウントが使えるコマンドの一覧をDMで返信する。長ければスレッドに分ける。
+func (bot *Persona) replyHelp(ctx context.Context, account mastodon.Account, status *mastodon.Status) (err error) {
+	var lines []string
+	admin := false
+	for _, c := range mentionCommands {
+		if !bot.permitted(c, account) {
+			continue
+		}
+		if c.Perm == permAdmin && !admin {
+			lines = append(lines, "\n管理者用：")
+			admin = true
+		}
+		line := "・" + strings.TrimSpace(c.Name+" "+c.Args)
+		if len(c.Aliases) > 0 {
+			line += "（" + strings.Join(c.Aliases, "、") + "）"
+		}
+		lines = append(lines, line+"："+c.Help)
+	}
+
+	head := "@" + account.Acct + " "
+	msgs := []string{head + "わかる言葉の一覧です。メンションかDMでどうぞ\n"}
+	for _, l := range lines {
+		if len([]rune(msgs[len(msgs)-1]+"\n"+l)) > digestMaxLen {
+			msgs = append(msgs, head)
+		}
+		msgs[len(msgs)-1] += "\n" + l
+	}
+
+	prev := status.ID
+	for _, msg := range msgs {
+		st, err := bot.postStatus(ctx, mastodon.Toot{Status: msg, Visibility: "direct", InReplyToID: prev})
+		if err != nil {
+			log.Printf("info: %s がヘルプを返信できませんでした", bot.Name)
+			return err
+		}
+		prev = st.ID
+	}
+	return
+}
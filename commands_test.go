@@ -0,0 +1,87 @@
+package tankabot
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// testBot は、DBやサーバーにつながずに、設定だけを持ったbotを作る。
+func testBot(s settings) *Persona {
+	bot := &Persona{Name: "testbot", live: new(atomic.Pointer[settings])}
+	bot.live.Store(&s)
+	return bot
+}
+
+func TestFindCommand(t *testing.T) {
+	bot := testBot(settings{Admins: []string{"@admin"}})
+	user := mastodon.Account{Acct: "alice@example.com"}
+	admin := mastodon.Account{Acct: "admin"}
+
+	tests := []struct {
+		name    string
+		account mastodon.Account
+		content string
+		want    string // want は、見つかるはずのコマンドの名前。見つからないはずなら空。
+		args    []string
+	}{
+		{"名前", user, "<p>@tankabot ヘルプ</p>", "ヘルプ", nil},
+		{"別名", user, "<p>@tankabot 使い方</p>", "ヘルプ", nil},
+		{"宛先が複数", user, "<p>@tankabot @bob@example.org ヘルプ</p>", "ヘルプ", nil},
+		{"長い方を選ぶ", user, "<p>@tankabot かるたの成績</p>", "かるたの成績", nil},
+		{"短い方", user, "<p>@tankabot かるた</p>", "かるた", nil},
+		{"通知設定と管理者の再開", admin, "<p>@tankabot 短歌通知再開</p>", "短歌通知再開", nil},
+		{"途中の言葉は無視", user, "<p>@tankabot 今日はかるたをしました</p>", "", nil},
+		{"引数", user, "<p>@tankabot 連歌 古池や 蛙飛び込む 水の音</p>", "連歌", []string{"古池や", "蛙飛び込む", "水の音"}},
+		{"フォロー解除は途中でも", user, "<p>@tankabot すみません、フォロー解除お願いします</p>", "フォロー解除", []string{"お願いします"}},
+		{"フォロー解除は先頭でも", user, "<p>@tankabot フォロー解除</p>", "フォロー解除", nil},
+		{"Exactは言葉だけ", admin, "<p>@tankabot 状態</p>", "状態", nil},
+		{"Exactに続きがあれば無視", admin, "<p>@tankabot 状態はどう？</p>", "", nil},
+		{"管理者のコマンド", admin, "<p>@tankabot 再開</p>", "再開", nil},
+		{"管理者でなければ無視", user, "<p>@tankabot 再開</p>", "", nil},
+		{"メンションの形の引数", admin, "<p>@tankabot 承認 @carol@example.net</p>", "承認", []string{"@carol@example.net"}},
+		{"管理者でなければ引数があっても無視", user, "<p>@tankabot 承認 @carol@example.net</p>", "", nil},
+		{"空", user, "<p>@tankabot</p>", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := bot.findCommand(tt.account, &mastodon.Status{Content: tt.content})
+			if tt.want == "" {
+				if req != nil {
+					t.Fatalf("got %q, want no command", req.Command.Name)
+				}
+				return
+			}
+			if req == nil {
+				t.Fatalf("got no command, want %q", tt.want)
+			}
+			if req.Command.Name != tt.want {
+				t.Errorf("got %q, want %q", req.Command.Name, tt.want)
+			}
+			if len(req.Args) != 0 || len(tt.args) != 0 {
+				if !reflect.DeepEqual(req.Args, tt.args) {
+					t.Errorf("args = %q, want %q", req.Args, tt.args)
+				}
+			}
+		})
+	}
+}
+
+func TestPermitted(t *testing.T) {
+	bot := testBot(settings{Admins: []string{"@admin"}})
+	everyone := &mentionCommand{Name: "ヘルプ", Perm: permEveryone}
+	adminOnly := &mentionCommand{Name: "状態", Perm: permAdmin}
+
+	if !bot.permitted(everyone, mastodon.Account{Acct: "alice"}) {
+		t.Error("everyone command should be permitted to anyone")
+	}
+	if bot.permitted(adminOnly, mastodon.Account{Acct: "alice"}) {
+		t.Error("admin command should not be permitted to non-admins")
+	}
+	if !bot.permitted(adminOnly, mastodon.Account{Acct: "admin"}) {
+		t.Error("admin command should be permitted to admins")
+	}
+}
@@ -0,0 +1,83 @@
+package tankabot
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// consentCache は、アカウントごとの同意の判定を、期限つきで覚えておく。
+type consentCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[mastodon.ID]consentEntry
+}
+
+type consentEntry struct {
+	ok      bool
+	expires time.Time
+}
+
+func newConsentCache(ttl time.Duration) *consentCache {
+	return &consentCache{ttl: ttl, entries: make(map[mastodon.ID]consentEntry)}
+}
+
+func (c *consentCache) get(id mastodon.ID) (ok, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found := c.entries[id]
+	if !found || time.Now().After(e.expires) {
+		delete(c.entries, id)
+		return false, false
+	}
+	return e.ok, true
+}
+
+func (c *consentCache) set(id mastodon.ID, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	// 期限切れのものを掃除
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[id] = consentEntry{ok: ok, expires: now.Add(c.ttl)}
+}
+
+// consents は、アカウントが短歌botとの関わりを拒んでいないかを返す。
+// botアカウント（ReplyToBotsがtrueでない限り）と、プロフィール文や補足情報にOptOutMarkersのどれかを書いているアカウントは拒んでいるとみなす。
+func (bot *Persona) consents(account mastodon.Account) bool {
+	if ok, found := bot.consent.get(account.ID); found {
+		return ok
+	}
+
+	ok := true
+	if account.Bot && !bot.cfg().ReplyToBots {
+		ok = false
+	} else if m := optOutMarker(account, bot.cfg().OptOutMarkers); m != "" {
+		log.Printf("info: %s が %s のプロフィールに %s を見つけました", bot.Name, account.Acct, m)
+		ok = false
+	}
+	bot.consent.set(account.ID, ok)
+	return ok
+}
+
+// optOutMarker は、プロフィール文と補足情報から、最初に見つかった拒否の印を返す。なければ空文字列を返す。
+func optOutMarker(account mastodon.Account, markers []string) string {
+	texts := []string{textContent(account.Note)}
+	for _, f := range account.Fields {
+		texts = append(texts, f.Name, textContent(f.Value))
+	}
+	profile := strings.ToLower(strings.Join(texts, "\n"))
+	for _, m := range markers {
+		if m != "" && strings.Contains(profile, strings.ToLower(m)) {
+			return m
+		}
+	}
+	return ""
+}
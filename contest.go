@@ -0,0 +1,201 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// contestEntry は、お題への応募作品を格納する。
+type contestEntry struct {
+	StatusID   mastodon.ID
+	Acct       string
+	Song       string
+	Accepted   bool
+	Favourites int64
+}
+
+// hashtagRegexp はテキスト中のハッシュタグにマッチする。
+var hashtagRegexp = regexp.MustCompile(`[#＃][^\s#＃]+`)
+
+// monitorContest は、お題のハッシュタグのストリーミングを監視して応募作品を審査する。
+func (bot *Persona) monitorContest(ctx context.Context, db DB) {
+	log.Printf("info: %s が #%s の監視を開始しました", bot.Name, bot.ContestHashtag)
+
+	// 応募作品は、一つの担当が待ち行列から順に審査する。あふれた分は捨てる
+	entries := make(chan *mastodon.Status, bot.EventQueueSize)
+	go func() {
+		for {
+			select {
+			case st := <-entries:
+				if err := bot.judgeEntry(ctx, db, st); err != nil {
+					log.Printf("info: %s が応募作品を審査できませんでした", bot.Name)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	open := func(ctx context.Context) (chan mastodon.Event, error) {
+		return bot.Client.NewWSClient().StreamingWSHashtag(ctx, bot.ContestHashtag, false)
+	}
+	dropped := 0
+	bot.supervise(ctx, bot.streams["hashtag"], 0, open, nil, func(ctx context.Context, ev mastodon.Event) {
+		if t, ok := ev.(*mastodon.UpdateEvent); ok {
+			select {
+			case entries <- t.Status:
+			default:
+				if dropped++; dropped == 1 || dropped%100 == 0 {
+					log.Printf("info: %s の応募作品の待ち行列があふれたので、投稿を捨てました（通算%d件）", bot.Name, dropped)
+				}
+			}
+		}
+	})
+
+	log.Printf("info: %s が今回の #%s の監視を終了しました：%s", bot.Name, bot.ContestHashtag, ctx.Err())
+}
+
+// judgeEntry は応募作品が短歌の定型に収まっているかを審査し、判定を返信して記録する。
+func (bot *Persona) judgeEntry(ctx context.Context, db DB, status *mastodon.Status) (err error) {
+	// 一時停止中と、ブーストと自分の投稿は無視
+	if bot.ctl.isPaused() || status.Reblog != nil || status.Account.ID == bot.MyID {
+		return
+	}
+	// botとの関わりを拒んでいる人やブロックリストに当たる投稿は審査しない
+	if !bot.consents(status.Account) || bot.blocked(status.Account, status.SpoilerText+"\n"+textContent(status.Content)) {
+		return
+	}
+
+	text := hashtagRegexp.ReplaceAllString(stripMentions(textContent(status.Content)), "")
+	if !isJap(text) {
+		return
+	}
+
+	fc := checkAgainst(text, songForms[:1], bot.langJobPool)
+	verdict := "合格"
+	switch {
+	case fc.valid():
+	case len(fc.kus) != len(fc.form.morae):
+		verdict = "句の数が合いません"
+	case fc.under() == 0:
+		verdict = "字余り"
+	default:
+		verdict = "字足らず"
+	}
+
+	morae := make([]string, 0, len(fc.kus))
+	for _, k := range fc.kus {
+		morae = append(morae, strconv.Itoa(k.morae))
+	}
+	entry := contestEntry{
+		StatusID: status.ID,
+		Acct:     status.Account.Acct,
+		Song:     joinKus(fc),
+		Accepted: verdict == "合格" || verdict == "字余り",
+	}
+
+	// 同じ投稿の審査は一度だけ
+	added, err := db.addContestEntry(bot, entry)
+	if err != nil || !added {
+		return
+	}
+
+	msg := "@" + status.Account.Acct + " 【" + verdict + "】（" + strings.Join(morae, "-") + "）"
+	if entry.Accepted {
+		msg += "\n\n#" + bot.ContestHashtag + " への応募を受け付けました！"
+	}
+	toot := mastodon.Toot{Status: msg, Visibility: "unlisted", InReplyToID: status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s が審査結果を返信できませんでした", bot.Name)
+	}
+	return
+}
+
+// contestTimer は、募集期間の終わりに結果発表をして、次の募集期間を始める。
+func (bot *Persona) contestTimer(ctx context.Context, db DB) {
+	start, err := db.contestStartedAt(bot)
+	if err != nil {
+		log.Printf("info: %s が募集期間の開始時刻を取得できませんでした", bot.Name)
+		return
+	}
+	if start.IsZero() {
+		start = time.Now()
+		if err := db.setContestStartedAt(bot, start); err != nil {
+			log.Printf("info: %s が募集期間を開始できませんでした", bot.Name)
+			return
+		}
+	}
+
+	for {
+		end := start.Add(time.Duration(bot.ContestDays) * 24 * time.Hour)
+		t := time.NewTimer(time.Until(end))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+
+		if err := bot.announceContest(ctx, db, start, end); err != nil {
+			log.Printf("info: %s が結果発表に失敗しました", bot.Name)
+			return
+		}
+		if err := db.setContestStartedAt(bot, end); err != nil {
+			log.Printf("info: %s が次の募集期間を開始できませんでした", bot.Name)
+			return
+		}
+		start = end
+	}
+}
+
+// announceContest は、募集期間中の合格作品をお気に入りの多い順に並べて発表する。
+func (bot *Persona) announceContest(ctx context.Context, db DB, start, end time.Time) (err error) {
+	entries, err := db.contestEntries(bot, start, end)
+	if err != nil {
+		log.Printf("info: %s が応募作品を集められませんでした", bot.Name)
+		return
+	}
+
+	// 最新のお気に入り数を取得（消された投稿と、応募後にブロックリストに載ったり関わりを拒んだりした人の作品は除外）
+	ranked := make([]contestEntry, 0, len(entries))
+	for _, e := range entries {
+		st, err := bot.Client.GetStatus(ctx, e.StatusID)
+		if err != nil {
+			log.Printf("info: %s が id:%s の応募作品を取得できませんでした：%s", bot.Name, string(e.StatusID), err)
+			continue
+		}
+		if !bot.consents(st.Account) || bot.blocked(st.Account, st.SpoilerText+"\n"+textContent(st.Content)) {
+			continue
+		}
+		e.Favourites = st.FavouritesCount
+		ranked = append(ranked, e)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Favourites > ranked[j].Favourites
+	})
+
+	msg := "#" + bot.ContestHashtag + " 結果発表です！\n\n"
+	if len(ranked) == 0 {
+		msg += "今回は応募がありませんでした。次回もお待ちしております"
+	}
+	for i, e := range ranked {
+		if i >= bot.ContestWinners {
+			break
+		}
+		msg += strconv.Itoa(i+1) + "位（★" + strconv.FormatInt(e.Favourites, 10) + "）@" + e.Acct + "\n『" + e.Song + "』\n\n"
+	}
+	msg = strings.TrimSpace(msg)
+
+	toot := mastodon.Toot{Status: msg}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s が結果発表をトゥートできませんでした", bot.Name)
+	}
+	return
+}
@@ -2,6 +2,9 @@ CREATE TABLE `bots` (
   `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
   `name` varchar(191) NOT NULL DEFAULT '',
   `checked_until` int(11) unsigned NOT NULL DEFAULT '0',
+  `contest_started_at` datetime DEFAULT NULL,
+  `last_status_id` varchar(64) DEFAULT NULL,
+  `follows_synced_at` datetime DEFAULT NULL,
   `created_at` datetime DEFAULT NULL,
   `updated_at` datetime DEFAULT NULL,
   PRIMARY KEY (`id`),
@@ -43,3 +46,184 @@ CREATE TABLE `rss_feeds` (
   PRIMARY KEY (`id`),
   UNIQUE KEY `url` (`url`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `contest_entries` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `bot_id` int(11) unsigned NOT NULL,
+  `status_id` varchar(64) NOT NULL,
+  `acct` varchar(191) NOT NULL DEFAULT '',
+  `song` varchar(2000) DEFAULT '',
+  `accepted` tinyint(1) unsigned DEFAULT '0',
+  `created_at` datetime DEFAULT NULL,
+  `updated_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `entry_per_bot` (`bot_id`,`status_id`),
+  KEY `created_at` (`bot_id`,`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `renga_chains` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `bot_id` int(11) unsigned NOT NULL,
+  `root_status_id` varchar(64) NOT NULL,
+  `last_status_id` varchar(64) NOT NULL,
+  `last_acct` varchar(191) NOT NULL DEFAULT '',
+  `next_form` varchar(16) NOT NULL DEFAULT '',
+  `links` int(11) unsigned NOT NULL DEFAULT '0',
+  `finished` tinyint(1) unsigned DEFAULT '0',
+  `created_at` datetime DEFAULT NULL,
+  `updated_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `root_per_bot` (`bot_id`,`root_status_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `renga_links` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `chain_id` int(11) unsigned NOT NULL,
+  `status_id` varchar(64) NOT NULL,
+  `acct` varchar(191) NOT NULL DEFAULT '',
+  `verse` varchar(500) DEFAULT '',
+  `created_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `link_per_chain` (`chain_id`,`status_id`),
+  KEY `status_id` (`status_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `karuta_quizzes` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `bot_id` int(11) unsigned NOT NULL,
+  `question_status_id` varchar(64) NOT NULL,
+  `poem_number` int(11) unsigned NOT NULL,
+  `acct` varchar(191) NOT NULL DEFAULT '',
+  `answered` tinyint(1) unsigned DEFAULT '0',
+  `created_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `question_per_bot` (`bot_id`,`question_status_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `karuta_scores` (
+  `bot_id` int(11) unsigned NOT NULL,
+  `acct` varchar(191) NOT NULL,
+  `correct` int(11) unsigned NOT NULL DEFAULT '0',
+  `answered` int(11) unsigned NOT NULL DEFAULT '0',
+  `created_at` datetime DEFAULT NULL,
+  `updated_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`bot_id`,`acct`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `phrase_bank` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `bot_id` int(11) unsigned NOT NULL,
+  `surface` varchar(100) NOT NULL DEFAULT '',
+  `reading` varchar(200) NOT NULL DEFAULT '',
+  `mora_count` int(11) unsigned NOT NULL,
+  `source` varchar(16) NOT NULL DEFAULT '',
+  `created_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `phrase_per_bot` (`bot_id`,`surface`),
+  KEY `mora_count` (`bot_id`,`mora_count`),
+  KEY `reading` (`bot_id`,`reading`(100))
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `processed_statuses` (
+  `bot_id` int(11) unsigned NOT NULL,
+  `kind` varchar(16) NOT NULL,
+  `status_id` varchar(64) NOT NULL,
+  `created_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`bot_id`,`kind`,`status_id`),
+  KEY `created_at` (`bot_id`,`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `replies` (
+  `bot_id` int(11) unsigned NOT NULL,
+  `status_id` varchar(64) NOT NULL,
+  `kind` varchar(16) NOT NULL DEFAULT 'tanka',
+  `reply_id` varchar(64) NOT NULL,
+  `acct` varchar(191) NOT NULL DEFAULT '',
+  `tankas` text,
+  `created_at` datetime DEFAULT NULL,
+  `updated_at` datetime DEFAULT NULL,
+  `checked_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`bot_id`,`status_id`,`kind`),
+  KEY `reply_id` (`bot_id`,`reply_id`),
+  KEY `acct` (`bot_id`,`acct`,`created_at`),
+  KEY `created_at` (`bot_id`,`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `account_prefs` (
+  `bot_id` int(11) unsigned NOT NULL,
+  `acct` varchar(191) NOT NULL,
+  `muted` tinyint(1) unsigned NOT NULL DEFAULT '0',
+  `policy` varchar(16) NOT NULL DEFAULT '',
+  `unfollowed` varchar(16) NOT NULL DEFAULT '',
+  `created_at` datetime DEFAULT NULL,
+  `updated_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`bot_id`,`acct`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `reply_log` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `bot_id` int(11) unsigned NOT NULL,
+  `status_id` varchar(64) NOT NULL,
+  `kind` varchar(16) NOT NULL DEFAULT 'tanka',
+  `acct` varchar(191) NOT NULL DEFAULT '',
+  `created_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `acct` (`bot_id`,`acct`,`created_at`),
+  KEY `created_at` (`bot_id`,`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `suppressed_tankas` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `bot_id` int(11) unsigned NOT NULL,
+  `status_id` varchar(64) NOT NULL,
+  `acct` varchar(191) NOT NULL DEFAULT '',
+  `url` varchar(2000) NOT NULL DEFAULT '',
+  `tankas` text,
+  `reason` varchar(32) NOT NULL DEFAULT '',
+  `digested` tinyint(1) unsigned NOT NULL DEFAULT '0',
+  `created_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `status_per_bot` (`bot_id`,`status_id`),
+  KEY `digested` (`bot_id`,`digested`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `follow_requests` (
+  `bot_id` int(11) unsigned NOT NULL,
+  `account_id` varchar(64) NOT NULL,
+  `acct` varchar(191) NOT NULL DEFAULT '',
+  `created_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`bot_id`,`account_id`),
+  KEY `acct` (`bot_id`,`acct`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `blocklist` (
+  `bot_id` int(11) unsigned NOT NULL,
+  `kind` varchar(16) NOT NULL,
+  `value` varchar(191) NOT NULL,
+  `source` varchar(16) NOT NULL DEFAULT '',
+  `created_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`bot_id`,`kind`,`value`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `news_toots` (
+  `bot_id` int(11) unsigned NOT NULL,
+  `status_id` varchar(64) NOT NULL,
+  `item_id` int(11) unsigned NOT NULL,
+  `url` varchar(255) NOT NULL DEFAULT '',
+  `source` varchar(191) NOT NULL DEFAULT '',
+  `songs` varchar(2000) DEFAULT '',
+  `created_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`bot_id`,`status_id`),
+  KEY `source` (`bot_id`,`source`,`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `engagements` (
+  `bot_id` int(11) unsigned NOT NULL,
+  `status_id` varchar(64) NOT NULL,
+  `status_kind` varchar(16) NOT NULL DEFAULT '',
+  `kind` varchar(16) NOT NULL,
+  `acct` varchar(191) NOT NULL,
+  `created_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`bot_id`,`status_id`,`kind`,`acct`),
+  KEY `acct` (`bot_id`,`kind`,`acct`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
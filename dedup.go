@@ -0,0 +1,37 @@
+package tankabot
+
+import (
+	"log"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// processedRetention は、処理済みのステータスや通知を覚えておく期間。
+const processedRetention = 7 * 24 * time.Hour
+
+// claim は、ステータスや通知を処理済みとして記録し、まだ誰も処理していなければtrueを返す。
+// 再接続・遡り・複数の経路で同じものが届いても、処理するのは最初の一回だけになる。
+// DBに記録できなかった時は、取りこぼさないように処理する側に倒す。
+func (bot *Persona) claim(db DB, kind string, id mastodon.ID) bool {
+	claimed, err := db.claimProcessed(bot, kind, id)
+	if err != nil {
+		log.Printf("info: %s が %s id:%s の処理済み記録に失敗しました", bot.Name, kind, string(id))
+		return true
+	}
+	return claimed
+}
+
+// unclaim は、処理に失敗したステータスや通知の記録を取り消して、次の機会にやり直せるようにする。
+func (bot *Persona) unclaim(db DB, kind string, id mastodon.ID) {
+	if err := db.releaseProcessed(bot, kind, id); err != nil {
+		log.Printf("info: %s が %s id:%s の処理済み記録を取り消せませんでした", bot.Name, kind, string(id))
+	}
+}
+
+// forgetProcessed は、processedRetentionより古い処理済みの記録を消す。
+func (bot *Persona) forgetProcessed(db DB) {
+	if err := db.expireProcessed(bot, time.Now().Add(-processedRetention)); err != nil {
+		log.Printf("info: %s が古い処理済み記録を削除できませんでした", bot.Name)
+	}
+}
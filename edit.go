@@ -0,0 +1,226 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+const (
+	replyCheckPeriod   = 7 * 24 * time.Hour // replyCheckPeriod は、元の投稿がまだあるかを確かめる返信の期間。
+	replyCheckInterval = 3 * time.Hour
+)
+
+// botの返信の種類。一つの投稿に、種類ごとに一つずつ返信を記録する。
+const (
+	replyTanka      = "tanka"      // タイムラインの投稿に短歌を知らせた返信
+	replyReferenced = "referenced" // 「詠んで」と頼まれて、リプライ先の投稿の短歌を知らせた返信
+	replyKaeshiuta  = "kaeshiuta"  // 返歌
+)
+
+// botReply は、投稿とそれに短歌を知らせたbotの返信の対応を格納する。
+// Tankas は、返信が元にした短歌。StatusID の投稿が編集されて短歌が変わったら、返信を直すか消す。
+type botReply struct {
+	StatusID mastodon.ID
+	Kind     string
+	ReplyID  mastodon.ID
+	Acct     string
+	Tankas   string
+}
+
+// rememberReply は、投稿とbotの返信の対応を記録する。
+func (bot *Persona) rememberReply(db DB, rep botReply) {
+	if err := db.addReply(bot, rep); err != nil {
+		log.Printf("info: %s が返信の対応を記録できませんでした", bot.Name)
+	}
+	// 短歌を知らせる返信は、holdBackで返信のログに加えてある
+	if rep.Kind != replyTanka {
+		if err := db.logReply(bot, rep.StatusID, rep.Kind, rep.Acct); err != nil {
+			log.Printf("info: %s が返信をログに記録できませんでした", bot.Name)
+		}
+	}
+}
+
+// respondToEdit は、編集された投稿から改めて短歌を探す。
+// 短歌が変われば返信を編集し、なくなれば返信を削除し、新たに現れれば返信する。
+func (bot *Persona) respondToEdit(ctx context.Context, db DB, ev *mastodon.UpdateEditEvent) (err error) {
+	orig := ev.Status
+	if bot.ctl.isPaused() {
+		return
+	}
+
+	// メンション・ブースト・プライベート・自分の投稿は無視
+	if len(orig.Mentions) != 0 || orig.Reblog != nil || orig.Visibility == "private" || orig.Account.ID == bot.MyID {
+		return
+	}
+
+	// botとの関わりを拒むようになった人や、ブロックリストに当たるようになった投稿への返信は消す
+	if !bot.consents(orig.Account) || bot.blocked(orig.Account, orig.SpoilerText+"\n"+textContent(orig.Content)) {
+		if err = bot.retractReplies(ctx, db, orig.ID); err == nil {
+			bot.unclaim(db, "edit", orig.ID)
+		}
+		return
+	}
+
+	rep, err := db.replyTo(bot, orig.ID)
+	if err != nil {
+		log.Printf("info: %s が返信の対応を取得できませんでした", bot.Name)
+		return
+	}
+
+	text := textContent(orig.Content)
+	tankas := extractTankas(text, bot.langJobPool)
+	prefs := bot.prefsFor(db, orig.Account.Acct)
+
+	// NGワードが入ったら返信は消し、悲しい話題やセンシティブな投稿には控えめに返信する
+	level := bot.contentLevel(orig.SpoilerText, text, tankas)
+	if level == contentNG {
+		tankas = ""
+	}
+	quiet := level == contentQuiet || orig.Sensitive
+
+	// 返歌や「詠んで」への返信は元の短歌をそのまま引いているので、短歌が変わったら消す
+	if others, err := db.repliesTo(bot, orig.ID); err == nil {
+		for _, o := range others {
+			if o.Kind != replyTanka && o.Tankas != tankas {
+				bot.retractReply(ctx, db, o)
+			}
+		}
+	}
+
+	switch {
+	case rep.ReplyID == "" && tankas == "":
+		return
+	case rep.ReplyID == "":
+		// 編集で短歌が現れた（短歌通知を止めている人や、返信以外で知らせてほしい人には返信しない）
+		policy := bot.policyFor(prefs, orig)
+		if prefs.Muted || policy == policyFavourite || policy == policyDigest {
+			return
+		}
+		// 同じ編集の知らせが重なって届いても、返信は一度だけ
+		if !bot.claim(db, "edit", orig.ID) {
+			return
+		}
+		if bot.holdBack(db, orig, tankas, digestable(orig, policy, quiet)) {
+			bot.unclaim(db, "edit", orig.ID)
+			return
+		}
+		toot := bot.tankaToot(orig, tankas, quiet)
+		toot.Visibility = replyVisibility(policy, toot.Visibility)
+		var st *mastodon.Status
+		if st, err = bot.postStatus(ctx, toot); err != nil {
+			log.Printf("info: %s が編集された投稿にリプライできませんでした", bot.Name)
+			bot.releaseHold(db, orig)
+			bot.unclaim(db, "edit", orig.ID)
+			return
+		}
+		bot.rememberReply(db, botReply{StatusID: orig.ID, Kind: replyTanka, ReplyID: st.ID, Acct: orig.Account.Acct, Tankas: tankas})
+		if !quiet {
+			bot.harvestPhrases(db, tankas, "toot")
+		}
+		log.Printf("info: %s が編集で現れた短歌にリプライしました", bot.Name)
+	case tankas == "":
+		// 編集で短歌が消えた（また短歌が現れたら返信できるように、返信済みの印も外す）
+		if err = bot.retractReply(ctx, db, rep); err == nil {
+			bot.unclaim(db, "edit", orig.ID)
+		}
+	case tankas != rep.Tankas:
+		// 編集で短歌が変わった
+		if err = bot.editStatus(ctx, rep.ReplyID, bot.tankaToot(orig, tankas, quiet)); err != nil {
+			if notFound(err) {
+				// 返信が既に消されていたら、対応も忘れる
+				err = db.deleteReply(bot, rep)
+				return
+			}
+			log.Printf("info: %s が返信を編集できませんでした", bot.Name)
+			return
+		}
+		rep.Tankas = tankas
+		bot.rememberReply(db, rep)
+		log.Printf("info: %s が編集された投稿への返信を直しました", bot.Name)
+	}
+
+	return
+}
+
+// respondToDelete は、短歌を知らせた投稿が削除されたら、botの返信も削除する。
+func (bot *Persona) respondToDelete(ctx context.Context, db DB, ev *mastodon.DeleteEvent) (err error) {
+	return bot.retractReplies(ctx, db, ev.ID)
+}
+
+// retractReplies は、投稿へのbotの返信を、種類を問わず全て削除する。
+func (bot *Persona) retractReplies(ctx context.Context, db DB, statusID mastodon.ID) (err error) {
+	reps, err := db.repliesTo(bot, statusID)
+	if err != nil {
+		return
+	}
+	for _, rep := range reps {
+		if e := bot.retractReply(ctx, db, rep); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// retractReply は、botの返信を削除して、対応の記録も消す。
+func (bot *Persona) retractReply(ctx context.Context, db DB, rep botReply) (err error) {
+	if err = bot.deleteStatus(ctx, rep.ReplyID); err != nil && !notFound(err) {
+		log.Printf("info: %s が返信を削除できませんでした", bot.Name)
+		return
+	}
+	if err = db.deleteReply(bot, rep); err != nil {
+		log.Printf("info: %s が返信の対応を削除できませんでした", bot.Name)
+		return
+	}
+	log.Printf("info: %s が削除された投稿への返信を削除しました", bot.Name)
+	return
+}
+
+// checkReplies は、ctxが終わるまでreplyCheckIntervalごとに、最近返信した投稿がまだあるかを確かめ、
+// 消えていたら返信も削除する。寝ている間や定期取得中に受け取れなかった削除を拾うため。
+func (bot *Persona) checkReplies(ctx context.Context, db DB) {
+	for {
+		// 一つの投稿に短歌の返信と返歌があっても確かめるのは一度だけ。寝起きをまたいで、確かめたばかりの投稿も確かめない
+		now := time.Now()
+		ids, err := db.repliedStatuses(bot, now.Add(-replyCheckPeriod), now.Add(-replyCheckInterval))
+		if err != nil {
+			log.Printf("info: %s が最近の返信を確かめられませんでした", bot.Name)
+		}
+		n := 0
+		for _, id := range ids {
+			if !waitFor(ctx, time.Second) {
+				return
+			}
+			_, err := bot.Client.GetStatus(ctx, id)
+			switch {
+			case notFound(err):
+				if err := bot.retractReplies(ctx, db, id); err == nil {
+					n++
+				}
+			case err == nil:
+				if err := db.setRepliesChecked(bot, id, time.Now()); err != nil {
+					log.Printf("info: %s が返信を確かめた時刻を記録できませんでした", bot.Name)
+				}
+			}
+		}
+		if n > 0 {
+			log.Printf("info: %s が最近返信した投稿 %d 件を確かめ、消えていた %d 件への返信を削除しました", bot.Name, len(ids), n)
+		}
+
+		t := time.NewTimer(replyCheckInterval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// notFound は、APIのエラーが404（既に削除されているなど）かどうかを返す。
+func notFound(err error) bool {
+	apiErr, ok := err.(*mastodon.APIError)
+	return ok && apiErr.StatusCode == 404
+}
@@ -0,0 +1,76 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// botの投稿の種類
+const (
+	ownStatusReply = "reply" // 短歌を見つけた時の返信
+	ownStatusNews  = "news"  // ネットの記事から拾った短歌
+	ownStatusOther = "other" // それ以外
+)
+
+// sourceStats は、記事の出どころごとの、投稿数と反応の数を格納する。
+type sourceStats struct {
+	Source     string
+	Toots      int
+	Favourites int
+	Reblogs    int
+}
+
+// sourceOf は、記事のURLから出どころ（ホスト名）を取り出す。
+func sourceOf(itemURL string) string {
+	u, err := url.Parse(itemURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+}
+
+// postNews は、ネットの記事から拾った短歌を投稿し、どの記事から詠んだかを記録して、記事を候補から外す。
+func (bot *Persona) postNews(ctx context.Context, db DB, toot mastodon.Toot, item Item) (err error) {
+	st, err := bot.postStatus(ctx, toot)
+	if err != nil {
+		return
+	}
+	if err := db.addNewsToot(bot, st.ID, item, sourceOf(item.URL)); err != nil {
+		log.Printf("info: %s が投稿した記事を記録できませんでした", bot.Name)
+	}
+	if err := db.deleteItem(bot, item); err != nil {
+		log.Printf("info: %s がトゥート済みアイテムの削除に失敗しました", bot.Name)
+	}
+	return
+}
+
+// respondToEngagement は、botの投稿へのふぁぼやブーストを記録する。
+// 設定されていれば、初めてブーストしてくれた人にお礼をDMする。
+func (bot *Persona) respondToEngagement(ctx context.Context, db DB, n *mastodon.Notification) (err error) {
+	if n.Status == nil || n.Status.Account.ID != bot.MyID {
+		return
+	}
+
+	kind, err := db.ownStatusKind(bot, n.Status.ID)
+	if err != nil {
+		return
+	}
+	first, err := db.addEngagement(bot, n.Status.ID, kind, n.Type, n.Account.Acct)
+	if err != nil {
+		return
+	}
+	log.Printf("trace: %s の投稿 %s（%s）に %s から %s がありました", bot.Name, n.Status.ID, kind, n.Account.Acct, n.Type)
+
+	if !first || n.Type != "reblog" || bot.cfg().ReblogThanks == "" || !bot.consents(n.Account) || bot.blocked(n.Account, "") {
+		return
+	}
+	toot := mastodon.Toot{Status: "@" + n.Account.Acct + " " + bot.cfg().ReblogThanks, Visibility: "direct"}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s がブーストのお礼を送れませんでした", bot.Name)
+	}
+	return
+}
@@ -0,0 +1,39 @@
+package tankabot
+
+import (
+	"log"
+	"strings"
+)
+
+// 投稿の内容の扱い。
+const (
+	contentOK    = iota // 普段どおりに扱う
+	contentQuiet        // 控えめに扱う（ふぁぼらず、CWをつけ、公開範囲を狭める）
+	contentNG           // 扱わない
+)
+
+// defaultQuietWords は、QuietWordsを設定していない時に、控えめに扱う話題の言葉。
+// 言葉の一部として含むだけで当たるので、「殺風景」「忙殺される」や「テロップ」などに当たらないように、一字や広すぎる語は入れない。
+var defaultQuietWords = []string{
+	"訃報", "死去", "逝去", "亡くなりました", "亡くなった", "亡くなられ", "死亡事故", "殺人", "殺害",
+	"遺体", "自殺", "遺族", "被害者", "ご冥福", "お悔やみ", "追悼",
+	"災害", "震災", "被災", "大地震", "津波警報", "大津波", "噴火警報", "戦争", "空爆", "自爆テロ", "テロ事件",
+}
+
+// contentLevel は、文章の中にNGWordsかQuietWordsの言葉があるかを調べて、扱いを返す。
+func (bot *Persona) contentLevel(texts ...string) (level int) {
+	str := strings.ToLower(strings.Join(texts, "\n"))
+	for _, w := range bot.cfg().NGWords {
+		if w != "" && strings.Contains(str, strings.ToLower(w)) {
+			log.Printf("trace: %s がNGワード「%s」を見つけました", bot.Name, w)
+			return contentNG
+		}
+	}
+	for _, w := range bot.cfg().QuietWords {
+		if w != "" && strings.Contains(str, strings.ToLower(w)) {
+			log.Printf("trace: %s が控えめに扱う言葉「%s」を見つけました", bot.Name, w)
+			level = contentQuiet
+		}
+	}
+	return
+}
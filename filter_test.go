@@ -0,0 +1,28 @@
+package tankabot
+
+import "testing"
+
+func TestContentLevel(t *testing.T) {
+	bot := testBot(settings{NGWords: []string{"NGワード"}, QuietWords: defaultQuietWords})
+
+	tests := []struct {
+		name  string
+		texts []string
+		want  int
+	}{
+		{"普段の投稿", []string{"", "今日は良い天気ですね"}, contentOK},
+		{"一字では当たらない", []string{"", "殺風景な部屋を片付けて忙殺される"}, contentOK},
+		{"広すぎる語では当たらない", []string{"", "テロップの事故防止の事件簿"}, contentOK},
+		{"控えめに扱う言葉", []string{"", "祖父の訃報が届きました"}, contentQuiet},
+		{"CWの中の言葉", []string{"ご冥福をお祈りします", "本文"}, contentQuiet},
+		{"NGワードが優先", []string{"", "訃報とngワード"}, contentNG},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bot.contentLevel(tt.texts...); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
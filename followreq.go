@@ -0,0 +1,187 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// followRequest は、承認待ちのフォローリクエストを格納する。
+type followRequest struct {
+	AccountID mastodon.ID
+	Acct      string
+	CreatedAt time.Time
+}
+
+// isAdmin は、アカウントがbotの管理者かどうかを返す。
+func (bot *Persona) isAdmin(account mastodon.Account) bool {
+	for _, a := range bot.cfg().Admins {
+		if strings.TrimPrefix(a, "@") == account.Acct {
+			return true
+		}
+	}
+	return false
+}
+
+// domainOf は、acctのドメインを返す。同じインスタンスのアカウントなら空文字列を返す。
+func domainOf(acct string) string {
+	if i := strings.LastIndex(acct, "@"); i >= 0 {
+		return strings.ToLower(acct[i+1:])
+	}
+	return ""
+}
+
+// judgeFollowRequest は、設定のルールに従ってフォローリクエストの扱いを決める。
+// verdictは、approve（承認）、reject（拒否）、queue（管理者の判断待ち）のどれか。
+func (bot *Persona) judgeFollowRequest(account mastodon.Account) (verdict string) {
+	if bot.blocked(account, "") {
+		return "reject"
+	}
+	domain := domainOf(account.Acct)
+	for _, d := range bot.cfg().FollowRequestDenyDomains {
+		d = strings.ToLower(d)
+		if domain != "" && (domain == d || strings.HasSuffix(domain, "."+d)) {
+			return "reject"
+		}
+	}
+	if bot.cfg().FollowRequestMinAgeDays > 0 && time.Since(account.CreatedAt) < time.Duration(bot.cfg().FollowRequestMinAgeDays)*24*time.Hour {
+		return "queue"
+	}
+	switch bot.cfg().FollowRequestRule {
+	case "all":
+		return "approve"
+	case "local":
+		if domain == "" {
+			return "approve"
+		}
+	}
+	return "queue"
+}
+
+// respondToFollowRequest はフォローリクエストに反応する。判断のつかないものは管理者に知らせて待つ。
+func (bot *Persona) respondToFollowRequest(ctx context.Context, db DB, account mastodon.Account) (err error) {
+	switch bot.judgeFollowRequest(account) {
+	case "approve":
+		return bot.approveFollowRequest(ctx, db, account.ID, account.Acct)
+	case "reject":
+		return bot.rejectFollowRequest(ctx, db, account.ID, account.Acct)
+	}
+
+	if err = db.addFollowRequest(bot, followRequest{AccountID: account.ID, Acct: account.Acct}); err != nil {
+		log.Printf("info: %s がフォローリクエストを記録できませんでした", bot.Name)
+		return
+	}
+	log.Printf("info: %s が %s からのフォローリクエストを保留しました", bot.Name, account.Acct)
+	for _, a := range bot.cfg().Admins {
+		msg := "@" + strings.TrimPrefix(a, "@") + " " + account.Acct + " さんからフォローリクエストが届いています。「承認 " + account.Acct + "」か「拒否 " + account.Acct + "」とメンションしてください"
+		if err := bot.post(ctx, mastodon.Toot{Status: msg, Visibility: "direct"}); err != nil {
+			log.Printf("info: %s がフォローリクエストを管理者に知らせられませんでした", bot.Name)
+		}
+	}
+	return
+}
+
+// approveFollowRequest は、フォローリクエストを承認して、フォローバックする。
+func (bot *Persona) approveFollowRequest(ctx context.Context, db DB, id mastodon.ID, acct string) (err error) {
+	if err = bot.Client.FollowRequestAuthorize(ctx, id); err != nil && !notFound(err) {
+		log.Printf("info: %s が %s のフォローリクエストを承認できませんでした：%s", bot.Name, acct, err)
+		return
+	}
+	if err = db.deleteFollowRequest(bot, id); err != nil {
+		return
+	}
+	log.Printf("info: %s が %s のフォローリクエストを承認しました", bot.Name, acct)
+
+	acc, err := bot.Client.GetAccount(ctx, id)
+	if err != nil {
+		log.Printf("info: %s が %s の情報を取得できませんでした：%s", bot.Name, acct, err)
+		return
+	}
+	return bot.respondToFollow(ctx, db, *acc)
+}
+
+// rejectFollowRequest は、フォローリクエストを拒否する。
+func (bot *Persona) rejectFollowRequest(ctx context.Context, db DB, id mastodon.ID, acct string) (err error) {
+	if err = bot.Client.FollowRequestReject(ctx, id); err != nil && !notFound(err) {
+		log.Printf("info: %s が %s のフォローリクエストを拒否できませんでした：%s", bot.Name, acct, err)
+		return
+	}
+	if err = db.deleteFollowRequest(bot, id); err != nil {
+		return
+	}
+	log.Printf("info: %s が %s のフォローリクエストを拒否しました", bot.Name, acct)
+	return
+}
+
+// decideFollowRequest は、管理者のコマンドに従ってフォローリクエストを承認または拒否し、結果を返信する。
+func (bot *Persona) decideFollowRequest(ctx context.Context, db DB, approve bool, acct string, account mastodon.Account, status *mastodon.Status) (err error) {
+	acct = strings.TrimPrefix(acct, "@")
+
+	req, err := db.followRequestByAcct(bot, acct)
+	if err != nil {
+		return
+	}
+	if req.AccountID == "" {
+		// 記録になければ、サーバー側の承認待ちから探す
+		accs, err := bot.Client.GetFollowRequests(ctx, &mastodon.Pagination{Limit: 80})
+		if err != nil {
+			log.Printf("info: %s がフォローリクエスト一覧を取得できませんでした：%s", bot.Name, err)
+			return err
+		}
+		for _, a := range accs {
+			if a.Acct == acct {
+				req = followRequest{AccountID: a.ID, Acct: a.Acct}
+				break
+			}
+		}
+	}
+
+	msg := "@" + account.Acct + " "
+	switch {
+	case req.AccountID == "":
+		msg += acct + " さんからのフォローリクエストは見当たりません"
+	case approve:
+		if err = bot.approveFollowRequest(ctx, db, req.AccountID, acct); err != nil {
+			return
+		}
+		msg += acct + " さんのフォローリクエストを承認しました"
+	default:
+		if err = bot.rejectFollowRequest(ctx, db, req.AccountID, acct); err != nil {
+			return
+		}
+		msg += acct + " さんのフォローリクエストを拒否しました"
+	}
+
+	toot := mastodon.Toot{Status: msg, Visibility: "direct", InReplyToID: status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s がフォローリクエストの処理結果を返信できませんでした", bot.Name)
+	}
+	return
+}
+
+// listFollowRequests は、承認待ちのフォローリクエストの一覧を管理者に返信する。
+func (bot *Persona) listFollowRequests(ctx context.Context, db DB, account mastodon.Account, status *mastodon.Status) (err error) {
+	reqs, err := db.followRequests(bot)
+	if err != nil {
+		return
+	}
+
+	msg := "@" + account.Acct + " "
+	if len(reqs) == 0 {
+		msg += "承認待ちのフォローリクエストはありません"
+	} else {
+		msg += "承認待ちのフォローリクエスト："
+		for _, r := range reqs {
+			msg += "\n" + r.Acct + "（" + r.CreatedAt.Format("1/2 15:04") + "）"
+		}
+	}
+
+	toot := mastodon.Toot{Status: msg, Visibility: "direct", InReplyToID: status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s がフォローリクエストの一覧を返信できませんでした", bot.Name)
+	}
+	return
+}
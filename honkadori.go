@@ -0,0 +1,117 @@
+package tankabot
+
+import (
+	"strings"
+)
+
+// honkaMinMatch は、本歌取りとみなすのに必要な、読みの一致部分の最小の長さ（七音の句ひとつぶん）。
+const honkaMinMatch = 7
+
+// kanaIndex は、古典和歌の読みを三文字ずつの断片から引けるようにした索引。
+type kanaIndex struct {
+	poems    []classicPoem
+	readings [][]rune
+	grams    map[string][]int
+}
+
+// honkaIndex は、本歌取りの判定に使う索引。
+var honkaIndex = newKanaIndex(classicCorpus)
+
+// newKanaIndex は、古典和歌の仮名から索引を作る。
+func newKanaIndex(poems []classicPoem) (idx *kanaIndex) {
+	idx = &kanaIndex{poems: poems, grams: make(map[string][]int)}
+	for i, p := range poems {
+		rs := foldReading(p.KamiKana + p.ShimoKana)
+		idx.readings = append(idx.readings, rs)
+		seen := make(map[string]bool)
+		for j := 0; j+3 <= len(rs); j++ {
+			g := string(rs[j : j+3])
+			if !seen[g] {
+				seen[g] = true
+				idx.grams[g] = append(idx.grams[g], i)
+			}
+		}
+	}
+	return
+}
+
+// search は、読みと最も長く一致する部分を持つ古典和歌を探す。一致がhonkaMinMatchに満たなければfoundはfalseになる。
+func (idx *kanaIndex) search(str string) (poem classicPoem, found bool) {
+	rs := foldReading(str)
+
+	// 断片を多く共有する歌だけを候補にする
+	counts := make(map[int]int)
+	for j := 0; j+3 <= len(rs); j++ {
+		for _, i := range idx.grams[string(rs[j:j+3])] {
+			counts[i]++
+		}
+	}
+
+	best := 0
+	for i, c := range counts {
+		if c < honkaMinMatch-2 {
+			continue
+		}
+		if l := longestCommonRun(rs, idx.readings[i]); l > best {
+			best = l
+			poem = idx.poems[i]
+		}
+	}
+	found = best >= honkaMinMatch
+	return
+}
+
+// honkadoriNote は、検出した短歌のどれかが古典和歌に似ていれば、元歌を紹介する一文を返す。
+func honkadoriNote(tankas string, jpl chan int) (note string) {
+	notes := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, t := range strings.Split(tankas, "\n\n") {
+		t = strings.Trim(t, "『』")
+		p, ok := honkaIndex.search(reading(t, jpl))
+		if !ok || seen[p.title()] {
+			continue
+		}
+		seen[p.title()] = true
+		notes = append(notes, "本歌取りかも？ 元歌：『"+p.Kami+" "+p.Shimo+"』（"+p.title()+"）")
+	}
+	note = strings.Join(notes, "\n")
+	return
+}
+
+// foldReading は、読みを比較用にそろえる。語頭以外のハ行はワ行に寄せる。
+func foldReading(str string) []rune {
+	rs := []rune(normalizeKana(str))
+	for i := 1; i < len(rs); i++ {
+		switch rs[i] {
+		case 'は':
+			rs[i] = 'わ'
+		case 'ひ':
+			rs[i] = 'い'
+		case 'ふ':
+			rs[i] = 'う'
+		case 'へ':
+			rs[i] = 'え'
+		case 'ほ':
+			rs[i] = 'お'
+		}
+	}
+	return rs
+}
+
+// longestCommonRun は、二つの文字列に共通する最長の連続部分の長さを返す。
+func longestCommonRun(a, b []rune) (longest int) {
+	prev := make([]int, len(b)+1)
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				cur[j] = prev[j-1] + 1
+				if cur[j] > longest {
+					longest = cur[j]
+				}
+			}
+		}
+		prev = cur
+	}
+	return
+}
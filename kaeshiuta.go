@@ -0,0 +1,192 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"strings"
+	"unicode"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// bankPhrase は、返歌の材料にする句を格納する。
+type bankPhrase struct {
+	Surface   string
+	Reading   string
+	MoraCount int
+	Source    string
+}
+
+// tankaMorae は、短歌の句ごとの拍数。
+var tankaMorae = []int{5, 7, 5, 7, 7}
+
+// harvestPhrases は、検出した短歌を句に分けて句のバンクに蓄える。
+func (bot *Persona) harvestPhrases(db DB, tankas, source string) {
+	if bot.cfg().KaeshiutaRate <= 0 {
+		return
+	}
+
+	phrases := make([]bankPhrase, 0)
+	for _, t := range strings.Split(tankas, "\n\n") {
+		kus := strings.Split(strings.Trim(t, "『』"), " ")
+		if len(kus) != len(tankaMorae) {
+			continue
+		}
+		for i, ku := range kus {
+			phrases = append(phrases, bankPhrase{
+				Surface:   ku,
+				Reading:   reading(ku, bot.langJobPool),
+				MoraCount: tankaMorae[i],
+				Source:    source,
+			})
+		}
+	}
+
+	if err := db.addPhrases(bot, phrases); err != nil {
+		log.Printf("info: %s が句のバンクを更新できませんでした", bot.Name)
+	}
+}
+
+// harvestStock は、句のバンクにネットの記事の句がまだなければ、投稿候補にストックしてある短歌から句を蓄える。
+// 句のバンクができる前からストックしてあった短歌も、返歌の材料にするため。
+func (bot *Persona) harvestStock(db DB) {
+	if bot.cfg().KaeshiutaRate <= 0 {
+		return
+	}
+	if n, err := db.phraseCount(bot, "news"); err != nil || n > 0 {
+		return
+	}
+	songs, err := db.stockSongs(bot)
+	if err != nil || len(songs) == 0 {
+		return
+	}
+	for _, s := range songs {
+		bot.harvestPhrases(db, s, "news")
+	}
+	log.Printf("info: %s がストックしてあった %d 件の記事の短歌から句を蓄えました", bot.Name, len(songs))
+}
+
+// wantsKaeshiuta は、このアカウントへの返歌を詠むかどうかを、設定の頻度と対象アカウントから決める。
+func (bot *Persona) wantsKaeshiuta(acct string) bool {
+	if bot.cfg().KaeshiutaRate <= 0 || rand.Intn(100) >= bot.cfg().KaeshiutaRate {
+		return false
+	}
+	if len(bot.cfg().KaeshiutaAccounts) == 0 {
+		return true
+	}
+	for _, a := range bot.cfg().KaeshiutaAccounts {
+		if a == acct {
+			return true
+		}
+	}
+	return false
+}
+
+// replyKaeshiuta は、元の短歌の言葉を一つ借りた返歌を詠んで、公開範囲visで返信する。詠めなければ何もしない。
+func (bot *Persona) replyKaeshiuta(ctx context.Context, db DB, orig *mastodon.Status, tankas, vis string) (err error) {
+	uta, err := bot.composeKaeshiuta(db, tankas)
+	if err != nil || uta == "" {
+		return
+	}
+
+	msg := "@" + orig.Account.Acct + " 返歌を一首\n\n『" + uta + "』"
+	toot := mastodon.Toot{Status: msg, SpoilerText: orig.SpoilerText, Visibility: vis, InReplyToID: orig.ID}
+	rep, err := bot.postStatus(ctx, toot)
+	if err != nil {
+		log.Printf("info: %s が返歌を返信できませんでした", bot.Name)
+		return
+	}
+	bot.rememberReply(db, botReply{StatusID: orig.ID, Kind: replyKaeshiuta, ReplyID: rep.ID, Acct: orig.Account.Acct, Tankas: tankas})
+	return
+}
+
+// composeKaeshiuta は、元の短歌の名詞を含む句を一つ選び、残りの句を拍数の合う句で埋めて五七五七七を作る。
+func (bot *Persona) composeKaeshiuta(db DB, tankas string) (uta string, err error) {
+	used := make(map[string]bool)
+	for _, t := range strings.Split(tankas, "\n\n") {
+		for _, ku := range strings.Split(strings.Trim(t, "『』"), " ") {
+			used[ku] = true
+		}
+	}
+
+	// 元歌の言葉を詠み込んだ句を探す
+	keywords := keywordsOf(strings.ReplaceAll(tankas, " ", ""), bot.langJobPool)
+	rand.Shuffle(len(keywords), func(i, j int) { keywords[i], keywords[j] = keywords[j], keywords[i] })
+	var anchor bankPhrase
+	for _, kw := range keywords {
+		cands, err := db.phrasesContaining(bot, kw)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range cands {
+			if !used[c.Surface] {
+				anchor = c
+				break
+			}
+		}
+		if anchor.Surface != "" {
+			break
+		}
+	}
+	if anchor.Surface == "" {
+		return
+	}
+
+	// 詠み込む句の位置を拍数に合わせて選ぶ
+	slots := make([]int, 0)
+	for i, m := range tankaMorae {
+		if m == anchor.MoraCount {
+			slots = append(slots, i)
+		}
+	}
+	kus := make([]string, len(tankaMorae))
+	kus[slots[rand.Intn(len(slots))]] = anchor.Surface
+	used[anchor.Surface] = true
+
+	// 残りの句を埋める
+	for i, m := range tankaMorae {
+		if kus[i] != "" {
+			continue
+		}
+		cands, err := db.randomPhrases(bot, m, 10)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range cands {
+			if !used[c.Surface] {
+				kus[i] = c.Surface
+				used[c.Surface] = true
+				break
+			}
+		}
+		if kus[i] == "" {
+			return "", nil
+		}
+	}
+
+	uta = strings.Join(kus, " ")
+	return
+}
+
+// keywordsOf は、文字列から二拍以上の名詞を取り出す。
+func keywordsOf(str string, jpl chan int) (kws []string) {
+	seen := make(map[string]bool)
+	for _, n := range parse(str, jpl) {
+		if !n.nounOrSymbol || n.moraCount < 2 || seen[n.surface] {
+			continue
+		}
+		letter := false
+		for _, r := range n.surface {
+			if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana) {
+				letter = true
+				break
+			}
+		}
+		if letter {
+			seen[n.surface] = true
+			kws = append(kws, n.surface)
+		}
+	}
+	return
+}
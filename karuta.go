@@ -0,0 +1,152 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// karutaQuiz は、出題中のかるたクイズを格納する。
+type karutaQuiz struct {
+	ID         int
+	QuestionID mastodon.ID
+	Number     int
+	Acct       string
+}
+
+// hyakuninToot は、起きてしばらくしたら今日の百人一首を投稿する。
+func (bot *Persona) hyakuninToot(ctx context.Context) {
+	t := time.NewTimer(time.Duration(rand.Intn(50)+10) * time.Minute)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		return
+	}
+
+	p := hyakunin[(time.Now().YearDay()-1)%len(hyakunin)]
+	msg := "今日の百人一首\n\n" + p.Kami + "\n" + p.Shimo + "\n\n" + p.title() + "\n\n#百人一首"
+	if err := bot.post(ctx, mastodon.Toot{Status: msg}); err != nil {
+		log.Printf("info: %s が今日の百人一首をトゥートできませんでした。今回は諦めます……", bot.Name)
+	}
+}
+
+// startKaruta は、百人一首からランダムに一首選び、上の句を出題する。
+func (bot *Persona) startKaruta(ctx context.Context, db DB, account mastodon.Account, status *mastodon.Status) (err error) {
+	p := hyakunin[rand.Intn(len(hyakunin))]
+	msg := "@" + account.Acct + " 第" + strconv.Itoa(p.Number) + "番の上の句です。下の句をこの投稿へのリプライでどうぞ！\n\n『" + p.Kami + "』"
+	toot := mastodon.Toot{Status: msg, Visibility: stricterVisibility(status.Visibility, "unlisted"), InReplyToID: status.ID}
+	st, err := bot.postStatus(ctx, toot)
+	if err != nil {
+		log.Printf("info: %s がかるたを出題できませんでした", bot.Name)
+		return
+	}
+
+	quiz := karutaQuiz{QuestionID: st.ID, Number: p.Number, Acct: account.Acct}
+	if err = db.addKarutaQuiz(bot, quiz); err != nil {
+		log.Printf("info: %s がかるたの出題を記録できませんでした", bot.Name)
+	}
+	return
+}
+
+// judgeKaruta は、出題へのリプライを下の句の解答として採点する。
+func (bot *Persona) judgeKaruta(ctx context.Context, db DB, quiz karutaQuiz, account mastodon.Account, status *mastodon.Status) (err error) {
+	// 採点は一問につき一度だけ
+	closed, err := db.closeKarutaQuiz(quiz)
+	if err != nil || !closed {
+		return
+	}
+
+	p := hyakunin[quiz.Number-1]
+	correct := matchShimo(stripMentions(textContent(status.Content)), p, bot.langJobPool)
+	if err = db.addKarutaScore(bot, account.Acct, correct); err != nil {
+		log.Printf("info: %s がかるたの成績を記録できませんでした", bot.Name)
+		return
+	}
+
+	msg := "@" + account.Acct + " "
+	if correct {
+		msg += "お見事、正解です！🎉"
+	} else {
+		msg += "残念！ 正解は『" + p.Shimo + "』でした"
+	}
+	msg += "\n\n" + p.title()
+	if sc, err := bot.karutaScoreMessage(db, account.Acct); err == nil {
+		msg += "\n" + sc
+	}
+
+	toot := mastodon.Toot{Status: msg, Visibility: stricterVisibility(status.Visibility, "unlisted"), InReplyToID: status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s がかるたの採点結果を返信できませんでした", bot.Name)
+	}
+	return
+}
+
+// replyKarutaScore は、かるたの通算成績を返信する。
+func (bot *Persona) replyKarutaScore(ctx context.Context, db DB, account mastodon.Account, status *mastodon.Status) (err error) {
+	sc, err := bot.karutaScoreMessage(db, account.Acct)
+	if err != nil {
+		return
+	}
+
+	toot := mastodon.Toot{Status: "@" + account.Acct + " " + sc, Visibility: stricterVisibility(status.Visibility, "unlisted"), InReplyToID: status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s がかるたの成績を返信できませんでした", bot.Name)
+	}
+	return
+}
+
+// karutaScoreMessage は、かるたの通算成績を文章にする。
+func (bot *Persona) karutaScoreMessage(db DB, acct string) (msg string, err error) {
+	correct, answered, err := db.karutaScore(bot, acct)
+	if err != nil {
+		log.Printf("info: %s がかるたの成績を取得できませんでした", bot.Name)
+		return
+	}
+	if answered == 0 {
+		msg = "まだかるたの成績はありません。「かるた」とメンションすると出題します"
+		return
+	}
+	msg = "通算成績：" + strconv.Itoa(answered) + "問中" + strconv.Itoa(correct) + "問正解"
+	return
+}
+
+// matchShimo は、解答が下の句と一致するかを、表記・仮名・読みのいずれかで判定する。
+func matchShimo(answer string, p classicPoem, jpl chan int) bool {
+	a := normalizeKana(answer)
+	if a == "" {
+		return false
+	}
+	if a == normalizeKana(p.Shimo) || a == normalizeKana(p.ShimoKana) {
+		return true
+	}
+	return normalizeKana(reading(answer, jpl)) == normalizeKana(reading(p.Shimo, jpl))
+}
+
+// kanaFolder は、歴史的仮名遣いや小書き文字の揺れを吸収する。
+var kanaFolder = strings.NewReplacer(
+	"ゐ", "い", "ゑ", "え", "を", "お", "ぢ", "じ", "づ", "ず",
+	"ぁ", "あ", "ぃ", "い", "ぅ", "う", "ぇ", "え", "ぉ", "お",
+	"ゃ", "や", "ゅ", "ゆ", "ょ", "よ", "っ", "つ", "ゎ", "わ",
+)
+
+// normalizeKana は、カタカナをひらがなにして、漢字とひらがな以外を取り除き、仮名の揺れを吸収する。
+func normalizeKana(str string) string {
+	var b strings.Builder
+	for _, r := range str {
+		if r >= 'ァ' && r <= 'ヶ' {
+			r -= 'ァ' - 'ぁ'
+		}
+		if unicode.In(r, unicode.Hiragana, unicode.Han) {
+			b.WriteRune(r)
+		}
+	}
+	return kanaFolder.Replace(b.String())
+}
@@ -3,77 +3,77 @@ package tankabot
 import (
 	"context"
 	"log"
-	"math/rand"
 	"runtime"
-	"strings"
-	"time"
+	"strconv"
 
 	mastodon "github.com/hanage999/go-mastodon"
 )
 
-// moitor はwebsocketでタイムラインを監視して反応する。
-func (bot *Persona) monitor(ctx context.Context) {
+// monitor はwebsocketでタイムラインを監視して反応する。接続が切れても、ctxが生きている限り再接続する。
+// StreamingModeがpollingならRESTの定期取得で監視し、autoならストリーミングが続けて失敗した時に定期取得へ切り替える。
+func (bot *Persona) monitor(ctx context.Context, db DB) {
 	log.Printf("trace: Goroutines: %d", runtime.NumGoroutine())
 	log.Printf("info: %s がタイムライン監視を開始しました", bot.Name)
-	newCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	evch, err := bot.openStreaming(newCtx)
-	if err != nil {
-		log.Printf("info: %s がストリーミングを受信開始できませんでした", bot.Name)
+
+	if bot.StreamingMode == "polling" {
+		bot.poll(ctx)
+		log.Printf("info: %s が今回のタイムライン監視を終了しました：%s", bot.Name, ctx.Err())
 		return
 	}
 
-	ers := ""
-	for ev := range evch {
-		switch t := ev.(type) {
-		case *mastodon.UpdateEvent:
-			go func() {
-				if err := bot.respondToUpdate(newCtx, t); err != nil {
-					log.Printf("info: %s がトゥートに反応できませんでした", bot.Name)
-				}
-			}()
-		case *mastodon.NotificationEvent:
-			go func() {
-				if err := bot.respondToNotification(newCtx, t); err != nil {
-					log.Printf("info: %s が通知に反応できませんでした", bot.Name)
-				}
-			}()
-		case *mastodon.ErrorEvent:
-			ers = t.Error()
-			log.Printf("info: %s がエラーイベントを受信しました：%s", bot.Name, ers)
-		}
-	}
-
-	if ctx.Err() != nil {
-		log.Printf("info: %s が今回のタイムライン監視を終了しました：%s", bot.Name, ctx.Err())
-	} else {
-		itvl := rand.Intn(4000) + 1000
-		log.Printf("info: %s の接続が切れました。%dミリ秒後に再接続します：%s", bot.Name, itvl, ers)
-		time.Sleep(time.Duration(itvl) * time.Millisecond)
-		go bot.monitor(ctx)
+	maxFailures := 0
+	if bot.StreamingMode == "auto" {
+		maxFailures = autoFallbackFailures
+	}
+	// 寝ている間や再接続までの間に見逃した投稿を遡る
+	go bot.backfill(ctx, db)
+	reconnected := func(ctx context.Context) {
+		go bot.backfill(ctx, db)
+	}
+
+	gaveUp := bot.supervise(ctx, bot.streams["user"], maxFailures, bot.openStreaming, reconnected, func(ctx context.Context, ev mastodon.Event) {
+		bot.enqueue(ev)
+	})
+	if gaveUp {
+		log.Printf("info: %s がストリーミングを諦めて、定期取得でタイムライン監視を続けます", bot.Name)
+		go bot.backfill(ctx, db)
+		bot.poll(ctx)
 	}
+
+	log.Printf("info: %s が今回のタイムライン監視を終了しました：%s", bot.Name, ctx.Err())
 }
 
-// openStreaming はHTLのストリーミング接続を開始する。失敗したらmaxRetryを上限に再試行する。
+// openStreaming はHTLのストリーミング接続を開始する。再試行はsuperviseに任せる。
 func (bot *Persona) openStreaming(ctx context.Context) (evch chan mastodon.Event, err error) {
 	wsc := bot.Client.NewWSClient()
-	for i := 0; i < bot.commonSettings.maxRetry; i++ {
-		evch, err = wsc.StreamingWSUser(ctx)
-		if err == nil {
-			log.Printf("trace: %s のストリーミング受信開始に成功しました", bot.Name)
-			return
-		}
-		log.Printf("info: %s のストリーミング受信が開始できません：%s", bot.Name, err)
-		time.Sleep(bot.commonSettings.retryInterval)
+	evch, err = wsc.StreamingWSUser(ctx)
+	if err == nil {
+		log.Printf("trace: %s のストリーミング受信開始に成功しました", bot.Name)
 	}
-
-	log.Printf("info: %s のストリーミング受信開始がリトライ上限に達しました：%s", bot.Name, err)
 	return
 }
 
 // respondToUpdate はstatusに反応する。
-func (bot *Persona) respondToUpdate(ctx context.Context, ev *mastodon.UpdateEvent) (err error) {
-	orig := ev.Status
+func (bot *Persona) respondToUpdate(ctx context.Context, db DB, ev *mastodon.UpdateEvent) (err error) {
+	_, err = bot.respondToStatus(ctx, db, ev.Status)
+	return
+}
+
+// respondToStatus はホームタイムラインのstatusから短歌を探して返信する。返信したらrepliedはtrueになる。
+func (bot *Persona) respondToStatus(ctx context.Context, db DB, status *mastodon.Status) (replied bool, err error) {
+	// 一時停止中は、見たことにもしない（「再開」の時に、ここから遡って拾う）
+	if bot.ctl.isPaused() {
+		return
+	}
+
+	// どこまで見たかを記録
+	defer func() {
+		if err := db.setLastStatusID(bot, status.ID); err != nil {
+			log.Printf("info: %s が見たステータスを記録できませんでした", bot.Name)
+		}
+	}()
+
+	orig := status
 	rebl := false
 	if orig.Reblog != nil {
 		orig = orig.Reblog
@@ -81,12 +81,23 @@ func (bot *Persona) respondToUpdate(ctx context.Context, ev *mastodon.UpdateEven
 	}
 
 	// メンション・ブースト・プライベートは無視
-	if len(ev.Status.Mentions) != 0 || rebl || orig.Visibility == "private" {
+	if len(status.Mentions) != 0 || rebl || orig.Visibility == "private" {
 		return
 	}
 
-	// 自分の投稿は無視
-	if orig.Account.ID == bot.MyID {
+	// 自分の投稿と、botとの関わりを拒んでいる人やブロックリストに当たる投稿は無視
+	if orig.Account.ID == bot.MyID || !bot.consents(orig.Account) || bot.blocked(orig.Account, orig.SpoilerText+"\n"+textContent(orig.Content)) {
+		return
+	}
+
+	// 処理済みなら無視
+	if !bot.claim(db, "status", orig.ID) {
+		return
+	}
+
+	// 短歌通知を止めている人には返信しない
+	prefs := bot.prefsFor(db, orig.Account.Acct)
+	if prefs.Muted {
 		return
 	}
 
@@ -95,41 +106,120 @@ func (bot *Persona) respondToUpdate(ctx context.Context, ev *mastodon.UpdateEven
 	tankas := extractTankas(text, bot.langJobPool)
 
 	if tankas != "" {
-		msg := "@" + orig.Account.Acct + " 短歌を発見しました！\n\n" + tankas
-		st := ""
-		if orig.SpoilerText != "" {
-			st = "短歌を発見しました！"
-			msg = "@" + orig.Account.Acct + " \n\n" + tankas
+		// NGワードがあれば触れず、悲しい話題やセンシティブな投稿には控えめに返信する
+		level := bot.contentLevel(orig.SpoilerText, text, tankas)
+		if level == contentNG {
+			return
 		}
+		quiet := level == contentQuiet || orig.Sensitive
+
+		// 知らせ方によっては返信しない
+		policy := bot.policyFor(prefs, orig)
+		switch {
+		case quiet && (policy == policyFavourite || policy == policyDigest):
+			return
+		case policy == policyFavourite:
+			if err = bot.fav(ctx, orig.ID); err != nil {
+				log.Printf("info: %s がふぁぼを諦めました", bot.Name)
+			}
+			return
+		case policy == policyDigest:
+			err = bot.collect(ctx, db, orig, tankas)
+			return
+		}
+
+		// 返信しすぎないように
+		if bot.holdBack(db, orig, tankas, digestable(orig, policy, quiet)) {
+			return
+		}
+
 		// 短歌生成ありがとうのふぁぼ
-		if err = bot.fav(ctx, orig.ID); err != nil {
-			log.Printf("info: %s がふぁぼを諦めました", bot.Name)
+		if !quiet {
+			if err = bot.fav(ctx, orig.ID); err != nil {
+				log.Printf("info: %s がふぁぼを諦めました", bot.Name)
+			}
 		}
-		toot := mastodon.Toot{Status: msg, SpoilerText: st, Visibility: orig.Visibility, InReplyToID: orig.ID}
-		if err = bot.post(ctx, toot); err != nil {
+		toot := bot.tankaToot(orig, tankas, quiet)
+		toot.Visibility = replyVisibility(policy, toot.Visibility)
+		var rep *mastodon.Status
+		if rep, err = bot.postStatus(ctx, toot); err != nil {
 			log.Printf("info: %s がリプライに失敗しました", bot.Name)
-			return err
+			bot.releaseHold(db, orig)
+			bot.unclaim(db, "status", orig.ID)
+			return
+		}
+		replied = true
+		bot.rememberReply(db, botReply{StatusID: orig.ID, Kind: replyTanka, ReplyID: rep.ID, Acct: orig.Account.Acct, Tankas: tankas})
+
+		// 句を蓄えて、ときどき返歌を詠む（控えめに扱う投稿では、どちらもしない）
+		if quiet {
+			return
+		}
+		bot.harvestPhrases(db, tankas, "toot")
+		if bot.wantsKaeshiuta(orig.Account.Acct) {
+			if err = bot.replyKaeshiuta(ctx, db, orig, tankas, toot.Visibility); err != nil {
+				log.Printf("info: %s が返歌を詠めませんでした", bot.Name)
+			}
 		}
 	}
 
 	return
 }
 
+// tankaToot は、投稿から見つけた短歌を知らせる返信を作る。元の投稿にCWがあれば、返信にもCWをつける。
+// quietなら、はしゃがずにCWをつけ、公開の投稿にも未収載で返信する。
+func (bot *Persona) tankaToot(orig *mastodon.Status, tankas string, quiet bool) mastodon.Toot {
+	body := tankas
+	if note := honkadoriNote(tankas, bot.langJobPool); note != "" {
+		body += "\n\n" + note
+	}
+	if quiet {
+		return mastodon.Toot{Status: "@" + orig.Account.Acct + " \n\n" + body, SpoilerText: "短歌がありました", Visibility: stricterVisibility(orig.Visibility, "unlisted"), InReplyToID: orig.ID}
+	}
+	msg := "@" + orig.Account.Acct + " 短歌を発見しました！\n\n" + body
+	st := ""
+	if orig.SpoilerText != "" {
+		st = "短歌を発見しました！"
+		msg = "@" + orig.Account.Acct + " \n\n" + body
+	}
+	return mastodon.Toot{Status: msg, SpoilerText: st, Visibility: orig.Visibility, InReplyToID: orig.ID}
+}
+
 // respondToNotification は通知に反応する。
-func (bot *Persona) respondToNotification(ctx context.Context, ev *mastodon.NotificationEvent) (err error) {
+// 処理済みの通知には反応せず、削除だけする。
+func (bot *Persona) respondToNotification(ctx context.Context, db DB, ev *mastodon.NotificationEvent) (err error) {
+	// 一時停止中は、管理者からのメンション以外は削除せずに残しておく
+	if bot.ctl.isPaused() && !(ev.Notification.Type == "mention" && bot.isAdmin(ev.Notification.Account)) {
+		return
+	}
+
+	if !bot.claim(db, "notification", ev.Notification.ID) {
+		return bot.dismissNotification(ctx, ev.Notification.ID)
+	}
+
 	switch ev.Notification.Type {
 	case "mention":
-		if err = bot.respondToMention(ctx, ev.Notification.Account, ev.Notification.Status); err != nil {
+		if err = bot.respondToMention(ctx, db, ev.Notification.Account, ev.Notification.Status); err != nil {
 			log.Printf("info: %s がメンションに反応できませんでした：%s", bot.Name, err)
+			bot.unclaim(db, "notification", ev.Notification.ID)
+			return
+		}
+	case "follow_request":
+		if err = bot.respondToFollowRequest(ctx, db, ev.Notification.Account); err != nil {
+			log.Printf("info: %s がフォローリクエストに反応できませんでした：%s", bot.Name, err)
+			bot.unclaim(db, "notification", ev.Notification.ID)
+			return
+		}
+	case "reblog", "favourite":
+		if err = bot.respondToEngagement(ctx, db, ev.Notification); err != nil {
+			log.Printf("info: %s がふぁぼやブーストを記録できませんでした：%s", bot.Name, err)
+			bot.unclaim(db, "notification", ev.Notification.ID)
 			return
 		}
-	case "reblog":
-		// TODO
-	case "favourite":
-		// TODO
 	case "follow":
-		if err = bot.respondToFollow(ctx, ev.Notification.Account); err != nil {
+		if err = bot.respondToFollow(ctx, db, ev.Notification.Account); err != nil {
 			log.Printf("info: %s がフォローに反応できませんでした：%s", bot.Name, err)
+			bot.unclaim(db, "notification", ev.Notification.ID)
 			return
 		}
 	}
@@ -141,28 +231,183 @@ func (bot *Persona) respondToNotification(ctx context.Context, ev *mastodon.Noti
 }
 
 // respondToMention はメンションに反応する。
-func (bot *Persona) respondToMention(ctx context.Context, account mastodon.Account, status *mastodon.Status) (err error) {
-	txt := textContent(status.Content)
+func (bot *Persona) respondToMention(ctx context.Context, db DB, account mastodon.Account, status *mastodon.Status) (err error) {
+	req := bot.findCommand(account, status)
 
-	if strings.Contains(txt, "フォロー解除") {
-		rel, err := bot.relationWith(ctx, account.ID)
-		if err != nil {
-			log.Printf("info: %s が関係取得に失敗しました", bot.Name)
+	// ブロックリストに当たる人や、botとの関わりを拒んでいる人には応えない（フォローを外してほしいという頼みだけは聞く）
+	if !bot.isAdmin(account) && (bot.blocked(account, "") || !bot.consents(account)) {
+		if req != nil && req.Command.Name == "フォロー解除" {
+			return bot.runCommand(ctx, db, req)
+		}
+		return
+	}
+
+	// 一時停止中は、管理者のコマンド以外に応えない
+	if bot.ctl.isPaused() {
+		if req != nil && req.Command.Perm == permAdmin {
+			return bot.runCommand(ctx, db, req)
+		}
+		return
+	}
+
+	// 連歌の付句か、かるたの解答かどうか。付句や解答は、コマンドの言葉を含んでいてもコマンドとみなさない
+	var chain rengaChain
+	var quiz karutaQuiz
+	if pid := inReplyTo(status); pid != "" {
+		if chain, err = db.rengaChainByLink(bot, pid); err != nil {
+			log.Printf("info: %s が連歌の情報を取得できませんでした", bot.Name)
+			return
+		}
+		if quiz, err = db.karutaQuizByQuestion(bot, pid); err != nil {
+			log.Printf("info: %s がかるたの出題を取得できませんでした", bot.Name)
+			return
+		}
+	}
+
+	switch {
+	case chain.ID != 0:
+		if err = bot.respondToRenga(ctx, db, chain, account, status); err != nil {
+			log.Printf("info: %s が付句に反応できませんでした", bot.Name)
 			return err
 		}
-		if (*rel[0]).Following {
-			if err = bot.unfollow(ctx, account.ID); err != nil {
-				log.Printf("info: %s がアンフォローに失敗しました", bot.Name)
-				return err
-			}
+	case quiz.ID != 0 && quiz.Acct == account.Acct:
+		if err = bot.judgeKaruta(ctx, db, quiz, account, status); err != nil {
+			log.Printf("info: %s がかるたの解答を採点できませんでした", bot.Name)
+			return err
+		}
+	case req != nil:
+		if err = bot.runCommand(ctx, db, req); err != nil {
+			log.Printf("info: %s がコマンド「%s」に応えられませんでした", bot.Name, req.Command.Name)
+			return err
+		}
+	case status.Visibility == "direct":
+		if err = bot.checkDraftByDM(ctx, account, status); err != nil {
+			log.Printf("info: %s が下書きのチェック結果を返せませんでした", bot.Name)
+			return err
+		}
+	case inReplyTo(status) == "":
+		// スレッドの途中で名前が出ただけのものには応えない
+		if err = bot.replyUnknown(ctx, account, status); err != nil {
+			return err
+		}
+	}
+
+	return
+}
+
+// analyzeReferenced は、メンションのリプライ先の投稿から短歌を探し、スレッドに返信する。
+// リプライ先が非公開の投稿なら、中身には触れずにお断りする。
+func (bot *Persona) analyzeReferenced(ctx context.Context, db DB, account mastodon.Account, status *mastodon.Status) (err error) {
+	parent, err := bot.getStatus(ctx, inReplyTo(status))
+	if notFound(err) {
+		return commandError("リプライ先の投稿が見られませんでした。削除されたか、botからは見えない投稿のようです🙇")
+	}
+	if err != nil {
+		log.Printf("info: %s がリプライ先の投稿を取得できませんでした", bot.Name)
+		return
+	}
+
+	// 自分の投稿と、botとの関わりを拒んでいる人やブロックリストに当たる投稿は詠まない
+	if parent.Account.ID == bot.MyID || !bot.consents(parent.Account) || bot.blocked(account, "") || bot.blocked(parent.Account, parent.SpoilerText+"\n"+textContent(parent.Content)) {
+		return
+	}
+
+	msg := "@" + account.Acct + " "
+	st := ""
+	found := ""
+	vis := stricterVisibility(status.Visibility, parent.Visibility)
+	switch parent.Visibility {
+	case "private", "direct":
+		msg += "公開されていない投稿は詠めません🙇"
+		vis = "direct"
+	default:
+		text := textContent(parent.Content)
+		tankas := extractTankas(text, bot.langJobPool)
+		if tankas == "" {
+			msg += "その投稿には短歌が見つかりませんでした"
+			break
+		}
+		level := bot.contentLevel(parent.SpoilerText, text, tankas)
+		if level == contentNG {
+			msg += "その投稿を詠むのは控えます🙇"
+			break
 		}
+		found = tankas
+		if note := honkadoriNote(tankas, bot.langJobPool); note != "" {
+			tankas += "\n\n" + note
+		}
+		msg += "短歌を発見しました！\n\n" + tankas
+		switch {
+		case level == contentQuiet || parent.Sensitive:
+			st = "短歌がありました"
+			msg = "@" + account.Acct + " \n\n" + tankas
+			vis = stricterVisibility(vis, "unlisted")
+		case parent.SpoilerText != "":
+			st = "短歌を発見しました！"
+			msg = "@" + account.Acct + " \n\n" + tankas
+		}
+	}
+
+	toot := mastodon.Toot{Status: msg, SpoilerText: st, Visibility: vis, InReplyToID: status.ID}
+	rep, err := bot.postStatus(ctx, toot)
+	if err != nil {
+		log.Printf("info: %s がリプライに失敗しました", bot.Name)
+		return
+	}
+	// リプライ先の短歌を引いているので、リプライ先が編集・削除されたら直せるように覚えておく
+	if found != "" {
+		bot.rememberReply(db, botReply{StatusID: parent.ID, Kind: replyReferenced, ReplyID: rep.ID, Acct: account.Acct, Tankas: found})
+	}
+	return
+}
+
+// checkDraftByDM は、DMで送られてきた下書きの詩型をチェックし、結果をDMで返す。
+func (bot *Persona) checkDraftByDM(ctx context.Context, account mastodon.Account, status *mastodon.Status) (err error) {
+	draft := stripMentions(textContent(status.Content))
+
+	msg := "@" + account.Acct + " "
+	if !isJap(draft) {
+		msg += "短歌の下書きをDMで送っていただければ、音の数を数えます。句の切れ目には空白か改行を入れてください"
+	} else {
+		msg += "\n" + checkDraft(draft, bot.langJobPool).report()
 	}
 
+	toot := mastodon.Toot{Status: msg, Visibility: "direct", InReplyToID: status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s がDMへの返信に失敗しました", bot.Name)
+	}
 	return
 }
 
+// inReplyTo は、statusのリプライ先のIDを返す。リプライでなければ空文字列を返す。
+func inReplyTo(status *mastodon.Status) mastodon.ID {
+	switch id := status.InReplyToID.(type) {
+	case string:
+		return mastodon.ID(id)
+	case float64:
+		return mastodon.ID(strconv.FormatInt(int64(id), 10))
+	}
+	return ""
+}
+
+// stricterVisibility は、二つの公開範囲のうち狭い方を返す。
+func stricterVisibility(a, b string) string {
+	rank := map[string]int{"public": 0, "unlisted": 1, "private": 2, "direct": 3}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
 // respondToFollow はフォローに反応する。
-func (bot *Persona) respondToFollow(ctx context.Context, account mastodon.Account) (err error) {
+// botとの関わりを拒んでいる人やブロックリストに当たる人はフォローバックしない。
+func (bot *Persona) respondToFollow(ctx context.Context, db DB, account mastodon.Account) (err error) {
+	if !bot.consents(account) || bot.blocked(account, "") {
+		log.Printf("info: %s が %s をフォローバックしませんでした", bot.Name, account.Acct)
+		return
+	}
+	bot.clearUnfollowed(db, account.Acct)
+
 	rel, err := bot.relationWith(ctx, account.ID)
 	if err != nil {
 		log.Printf("info: %s が関係取得に失敗しました", bot.Name)
@@ -0,0 +1,122 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"strconv"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// 短歌を見つけた時の知らせ方。
+const (
+	policyThread    = "thread"    // 元の投稿と同じ公開範囲でスレッドに返信する
+	policyUnlisted  = "unlisted"  // 公開の投稿には未収載で返信する
+	policyDirect    = "direct"    // DMで返信する
+	policyFavourite = "favourite" // ふぁぼるだけで、返信しない
+	policyDigest    = "digest"    // ブックマークしておき、寝る前にまとめて紹介する
+)
+
+// digestMaxLen は、まとめの投稿一つあたりの最大文字数。
+const digestMaxLen = 480
+
+// validPolicy は、知らせ方として正しいかどうかを返す。
+func validPolicy(policy string) bool {
+	switch policy {
+	case policyThread, policyUnlisted, policyDirect, policyFavourite, policyDigest:
+		return true
+	}
+	return false
+}
+
+// policyFor は、アカウントの通知設定とbotの設定から、この投稿への知らせ方を決める。
+// 公開・未収載以外の投稿を、まとめで人目に触れる形で紹介することはしない。
+func (bot *Persona) policyFor(prefs accountPrefs, orig *mastodon.Status) (policy string) {
+	policy = bot.cfg().ReplyPolicy
+	if validPolicy(prefs.Policy) {
+		policy = prefs.Policy
+	}
+	if !digestable(orig, policy, false) && policy == policyDigest {
+		policy = policyDirect
+	}
+	return
+}
+
+// digestable は、見つけた短歌を、未収載のまとめで人目に触れる形で紹介してよいかどうかを返す。
+// 公開・未収載の投稿で、本人が公開範囲を狭めた知らせ方を選んでおらず、控えめに扱う投稿でない時に限る。
+func digestable(orig *mastodon.Status, policy string, quiet bool) bool {
+	if quiet || (orig.Visibility != "public" && orig.Visibility != "unlisted") {
+		return false
+	}
+	return policy == policyThread || policy == policyDigest
+}
+
+// replyVisibility は、知らせ方に応じた返信の公開範囲を返す。元の投稿より広くすることはない。
+func replyVisibility(policy, orig string) string {
+	switch policy {
+	case policyUnlisted, policyDirect:
+		return stricterVisibility(orig, policy)
+	}
+	return orig
+}
+
+// collect は、短歌を見つけた投稿をブックマークして、まとめて紹介するために記録する。
+func (bot *Persona) collect(ctx context.Context, db DB, orig *mastodon.Status, tankas string) (err error) {
+	if _, err = bot.Client.Bookmark(ctx, orig.ID); err != nil {
+		log.Printf("info: %s がブックマークできませんでした：%s", bot.Name, err)
+	}
+	sup := suppressedTanka{StatusID: orig.ID, Acct: orig.Account.Acct, URL: orig.URL, Tankas: tankas, Reason: policyDigest}
+	if err = db.addSuppressed(bot, sup); err != nil {
+		log.Printf("info: %s がまとめる短歌を記録できませんでした", bot.Name)
+	}
+	return
+}
+
+// postDigest は、まとめて紹介する短歌と、返信を控えた短歌を、未収載のスレッドにして投稿する。
+// 通知が飛ばないよう、アカウントにはメンションしない。
+func (bot *Persona) postDigest(ctx context.Context, db DB) {
+	sups, err := db.undigested(bot)
+	if err != nil || len(sups) == 0 {
+		return
+	}
+
+	// 一投稿に収まるように分ける
+	chunks := make([][]suppressedTanka, 0)
+	size := 0
+	for _, sup := range sups {
+		l := len([]rune(digestEntry(sup)))
+		if len(chunks) == 0 || size+l > digestMaxLen {
+			chunks = append(chunks, nil)
+			size = 0
+		}
+		chunks[len(chunks)-1] = append(chunks[len(chunks)-1], sup)
+		size += l
+	}
+
+	var prev mastodon.ID
+	for i, chunk := range chunks {
+		msg := "今日見つけた短歌のまとめ"
+		if len(chunks) > 1 {
+			msg += "（" + strconv.Itoa(i+1) + "/" + strconv.Itoa(len(chunks)) + "）"
+		}
+		for _, sup := range chunk {
+			msg += "\n\n" + digestEntry(sup)
+		}
+		st, err := bot.postStatus(ctx, mastodon.Toot{Status: msg, Visibility: "unlisted", InReplyToID: prev})
+		if err != nil {
+			log.Printf("info: %s が短歌のまとめを投稿できませんでした", bot.Name)
+			return
+		}
+		prev = st.ID
+		if err := db.markDigested(bot, chunk); err != nil {
+			log.Printf("info: %s が短歌のまとめを記録できませんでした", bot.Name)
+			return
+		}
+	}
+	log.Printf("info: %s が %d 首の短歌をまとめて紹介しました", bot.Name, len(sups))
+}
+
+// digestEntry は、まとめの中の一件を文章にする。
+func digestEntry(sup suppressedTanka) string {
+	return sup.Acct + " さんの投稿から\n" + sup.Tankas + "\n" + sup.URL
+}
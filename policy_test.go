@@ -0,0 +1,58 @@
+package tankabot
+
+import (
+	"testing"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+func TestDigestable(t *testing.T) {
+	tests := []struct {
+		name       string
+		visibility string
+		policy     string
+		quiet      bool
+		want       bool
+	}{
+		{"公開・スレッド", "public", policyThread, false, true},
+		{"未収載・まとめ", "unlisted", policyDigest, false, true},
+		{"控えめに扱う投稿", "public", policyThread, true, false},
+		{"フォロワー限定", "private", policyThread, false, false},
+		{"DM", "direct", policyDigest, false, false},
+		{"未収載で知らせてほしい人", "public", policyUnlisted, false, false},
+		{"DMで知らせてほしい人", "public", policyDirect, false, false},
+		{"ふぁぼで知らせてほしい人", "public", policyFavourite, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := digestable(&mastodon.Status{Visibility: tt.visibility}, tt.policy, tt.quiet); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyFor(t *testing.T) {
+	bot := testBot(settings{ReplyPolicy: policyDigest})
+
+	tests := []struct {
+		name       string
+		prefs      accountPrefs
+		visibility string
+		want       string
+	}{
+		{"botの設定", accountPrefs{}, "public", policyDigest},
+		{"本人の設定が優先", accountPrefs{Policy: policyUnlisted}, "public", policyUnlisted},
+		{"正しくない設定は無視", accountPrefs{Policy: "bogus"}, "unlisted", policyDigest},
+		{"まとめられない投稿はDM", accountPrefs{}, "private", policyDirect},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bot.policyFor(tt.prefs, &mastodon.Status{Visibility: tt.visibility}); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
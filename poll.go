@@ -0,0 +1,91 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// autoFallbackFailures は、StreamingModeがautoの時に、定期取得へ切り替えるまでのストリーミングの連続失敗回数。
+const autoFallbackFailures = 5
+
+// poll は、RESTでホームタイムラインと通知を定期的に取得して反応する。
+// 取得間隔は、新着があれば縮め、なければ延ばす。
+func (bot *Persona) poll(ctx context.Context) {
+	st := bot.streams["polling"]
+	st.up()
+	defer st.down(true)
+
+	minItvl := time.Duration(bot.PollingMinSec) * time.Second
+	maxItvl := time.Duration(bot.PollingMaxSec) * time.Second
+	itvl := minItvl
+
+	// 起点は今ある最新のもの（それより前はcheckNotificationsなどに任せる）
+	var sinceStatus, sinceNotif mastodon.ID
+	if ss, err := bot.Client.GetTimelineHome(ctx, &mastodon.Pagination{Limit: 1}); err == nil && len(ss) > 0 {
+		sinceStatus = ss[0].ID
+	}
+	if ns, err := bot.Client.GetNotifications(ctx, &mastodon.Pagination{Limit: 1}); err == nil && len(ns) > 0 {
+		sinceNotif = ns[0].ID
+	}
+
+	for {
+		t := time.NewTimer(itvl)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+
+		// 前回より後のものを、一ページに収まらなくても取りこぼさないように、古い方から空になるまでたどる
+		n := 0
+		for ctx.Err() == nil {
+			ss, err := bot.Client.GetTimelineHome(ctx, &mastodon.Pagination{MinID: sinceStatus, Limit: 40})
+			if err != nil {
+				st.setError(err.Error())
+				log.Printf("info: %s がホームタイムラインを取得できませんでした：%s", bot.Name, err)
+				break
+			}
+			if len(ss) == 0 {
+				break
+			}
+			for i := len(ss) - 1; i >= 0; i-- {
+				bot.enqueue(&mastodon.UpdateEvent{Status: ss[i]})
+			}
+			sinceStatus = ss[0].ID
+			n += len(ss)
+		}
+
+		for ctx.Err() == nil {
+			ns, err := bot.Client.GetNotifications(ctx, &mastodon.Pagination{MinID: sinceNotif, Limit: 40})
+			if err != nil {
+				st.setError(err.Error())
+				log.Printf("info: %s が通知一覧を取得できませんでした：%s", bot.Name, err)
+				break
+			}
+			if len(ns) == 0 {
+				break
+			}
+			for i := len(ns) - 1; i >= 0; i-- {
+				bot.enqueue(&mastodon.NotificationEvent{Notification: ns[i]})
+			}
+			sinceNotif = ns[0].ID
+			n += len(ns)
+		}
+
+		if n > 0 {
+			itvl /= 2
+		} else {
+			itvl = itvl * 3 / 2
+		}
+		if itvl < minItvl {
+			itvl = minItvl
+		} else if itvl > maxItvl {
+			itvl = maxItvl
+		}
+		log.Printf("trace: %s が定期取得で %d 件を受け取りました。次は %s 後です", bot.Name, n, itvl)
+	}
+}
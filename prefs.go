@@ -0,0 +1,71 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// accountPrefs は、アカウントごとの短歌通知の設定を格納する。
+type accountPrefs struct {
+	Acct   string
+	Muted  bool   // Muted なら、タイムラインの投稿に短歌を見つけても返信しない。
+	Policy string // Policy は、短歌を見つけた時の知らせ方（replyPoliciesのどれか）。空ならbotの設定に従う。
+}
+
+// フォローを外した理由。フォロー関係の見直しで、フォローバックしてよいかを決めるのに使う。
+const (
+	unfollowRequested = "requested" // 「フォロー解除」を頼まれた
+	unfollowDormant   = "dormant"   // 長く投稿していなかった
+)
+
+// prefCommands は、通知設定を変えるメンションのコマンドと、その時の返事。
+var prefCommands = []struct {
+	word  string
+	help  string
+	apply func(*accountPrefs)
+	reply string
+}{
+	{"短歌通知停止", "短歌を見つけても返信しないようにします", func(p *accountPrefs) { p.Muted = true }, "承知しました。これからは短歌を見つけても黙っています。「短歌通知再開」で元に戻ります"},
+	{"短歌通知再開", "短歌を見つけたらまた返信するようにします", func(p *accountPrefs) { p.Muted = false }, "承知しました。また短歌を見つけたらお知らせします"},
+	{"DMで通知", "短歌を見つけたらDMで知らせます", func(p *accountPrefs) { p.Muted, p.Policy = false, policyDirect }, "承知しました。これからは短歌を見つけたらDMでお知らせします"},
+	{"未収載で通知", "短歌を見つけたら未収載で知らせます", func(p *accountPrefs) { p.Muted, p.Policy = false, policyUnlisted }, "承知しました。これからは短歌を見つけたら未収載でお知らせします"},
+	{"公開で通知", "短歌を見つけたら元の投稿と同じ公開範囲で知らせます", func(p *accountPrefs) { p.Muted, p.Policy = false, policyThread }, "承知しました。これからは元の投稿と同じ公開範囲でお知らせします"},
+	{"ふぁぼで通知", "短歌を見つけたらふぁぼだけで知らせます", func(p *accountPrefs) { p.Muted, p.Policy = false, policyFavourite }, "承知しました。これからは短歌を見つけたら、ふぁぼだけでお知らせします"},
+	{"まとめて通知", "見つけた短歌を夜にまとめて紹介します", func(p *accountPrefs) { p.Muted, p.Policy = false, policyDigest }, "承知しました。これからは見つけた短歌を、夜にまとめてご紹介します"},
+	{"通知方法リセット", "知らせ方をbotの設定に戻します", func(p *accountPrefs) { p.Muted, p.Policy = false, "" }, "承知しました。お知らせの方法を元に戻しました"},
+}
+
+// prefsFor は、アカウントの通知設定を返す。取得できなければ既定の設定を返す。
+func (bot *Persona) prefsFor(db DB, acct string) (prefs accountPrefs) {
+	prefs, err := db.accountPrefs(bot, acct)
+	if err != nil {
+		log.Printf("info: %s が %s の通知設定を取得できませんでした", bot.Name, acct)
+		return accountPrefs{Acct: acct}
+	}
+	return
+}
+
+// setPrefs は、メンションのコマンドに従って通知設定を変え、結果をDMで返す。
+func (bot *Persona) setPrefs(ctx context.Context, db DB, cmd int, account mastodon.Account, status *mastodon.Status) (err error) {
+	prefs := bot.prefsFor(db, account.Acct)
+	prefCommands[cmd].apply(&prefs)
+	if err = db.setAccountPrefs(bot, prefs); err != nil {
+		log.Printf("info: %s が %s の通知設定を保存できませんでした", bot.Name, account.Acct)
+		return
+	}
+
+	toot := mastodon.Toot{Status: "@" + account.Acct + " " + prefCommands[cmd].reply, Visibility: "direct", InReplyToID: status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s が通知設定の変更を返信できませんでした", bot.Name)
+	}
+	return
+}
+
+// clearUnfollowed は、フォローを外した記録を消す。改めてフォローしてくれた人は、またフォローバックする。
+func (bot *Persona) clearUnfollowed(db DB, acct string) {
+	if err := db.setUnfollowed(bot, acct, ""); err != nil {
+		log.Printf("info: %s が %s のフォロー解除の記録を消せませんでした", bot.Name, acct)
+	}
+}
@@ -0,0 +1,152 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// QueueStats は、イベント待ち行列の状態のスナップショット。
+type QueueStats struct {
+	Updates              int // Updates は、処理待ちのタイムラインの投稿（編集・削除を含む）の数。
+	Notifications        int // Notifications は、処理待ちの通知の数。
+	DroppedUpdates       int64
+	DroppedNotifications int64
+}
+
+// eventQueue は、ストリーミングや定期取得で受け取ったイベントを、決まった数のワーカーに渡すための待ち行列。
+// 通知はタイムラインの投稿より優先して処理する。待ち行列があふれたら、新しく来たイベントを捨てる。
+type eventQueue struct {
+	updates              chan mastodon.Event
+	notifications        chan *mastodon.NotificationEvent
+	droppedUpdates       int64
+	droppedNotifications int64
+}
+
+// newEventQueue は、投稿と通知それぞれsize件まで溜められる待ち行列を作る。
+func newEventQueue(size int) *eventQueue {
+	return &eventQueue{
+		updates:       make(chan mastodon.Event, size),
+		notifications: make(chan *mastodon.NotificationEvent, size),
+	}
+}
+
+// enqueue は、イベントを待ち行列に入れる。あふれたイベントは捨てて数える。
+// 捨てた通知は削除されずに残るので、次に起きた時のcheckNotificationsで拾われる。
+func (bot *Persona) enqueue(ev mastodon.Event) {
+	q := bot.events
+	switch e := ev.(type) {
+	case *mastodon.UpdateEvent, *mastodon.UpdateEditEvent, *mastodon.DeleteEvent:
+		select {
+		case q.updates <- e:
+		default:
+			if n := atomic.AddInt64(&q.droppedUpdates, 1); n == 1 || n%100 == 0 {
+				log.Printf("info: %s の待ち行列があふれたので、投稿を捨てました（通算%d件）", bot.Name, n)
+			}
+		}
+	case *mastodon.NotificationEvent:
+		select {
+		case q.notifications <- e:
+		default:
+			if n := atomic.AddInt64(&q.droppedNotifications, 1); n == 1 || n%100 == 0 {
+				log.Printf("info: %s の待ち行列があふれたので、通知を後回しにしました（通算%d件）", bot.Name, n)
+			}
+		}
+	}
+}
+
+// QueueStats は、botのイベント待ち行列の状態を返す。
+func (bot *Persona) QueueStats() QueueStats {
+	q := bot.events
+	return QueueStats{
+		Updates:              len(q.updates),
+		Notifications:        len(q.notifications),
+		DroppedUpdates:       atomic.LoadInt64(&q.droppedUpdates),
+		DroppedNotifications: atomic.LoadInt64(&q.droppedNotifications),
+	}
+}
+
+// startWorkers は、ctxが終わるまで待ち行列のイベントを処理するワーカーをEventWorkers個起動する。
+// ctxが終わったら、処理しきれなかったイベントは捨てる。次に起きた時に何時間も前の投稿に返信しないように。
+func (bot *Persona) startWorkers(ctx context.Context, db DB) {
+	// 前の日の終わりに滑り込んだものも捨てる
+	bot.discardEvents()
+	for i := 0; i < bot.EventWorkers; i++ {
+		go bot.work(ctx, db)
+	}
+	go func() {
+		<-ctx.Done()
+		bot.discardEvents()
+	}()
+}
+
+// discardEvents は、待ち行列に残っているイベントを捨てる。
+// 通知はサーバーで削除されずに残るので、次に起きた時のcheckNotificationsで拾う。
+func (bot *Persona) discardEvents() {
+	q := bot.events
+	updates, notifications := 0, 0
+	for {
+		select {
+		case <-q.updates:
+			updates++
+			continue
+		case <-q.notifications:
+			notifications++
+			continue
+		default:
+		}
+		break
+	}
+	if updates+notifications > 0 {
+		log.Printf("info: %s が処理しきれなかった投稿%d件と通知%d件を待ち行列から捨てました", bot.Name, updates, notifications)
+	}
+}
+
+// work は、待ち行列からイベントを一つずつ取り出して処理する。通知が待っていれば先に処理する。
+func (bot *Persona) work(ctx context.Context, db DB) {
+	q := bot.events
+	for {
+		select {
+		case ev := <-q.notifications:
+			bot.handleNotification(ctx, db, ev)
+			continue
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		select {
+		case ev := <-q.notifications:
+			bot.handleNotification(ctx, db, ev)
+		case ev := <-q.updates:
+			bot.handleUpdate(ctx, db, ev)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (bot *Persona) handleUpdate(ctx context.Context, db DB, ev mastodon.Event) {
+	switch e := ev.(type) {
+	case *mastodon.UpdateEvent:
+		if err := bot.respondToUpdate(ctx, db, e); err != nil {
+			log.Printf("info: %s がトゥートに反応できませんでした", bot.Name)
+		}
+	case *mastodon.UpdateEditEvent:
+		if err := bot.respondToEdit(ctx, db, e); err != nil {
+			log.Printf("info: %s が編集されたトゥートに反応できませんでした", bot.Name)
+		}
+	case *mastodon.DeleteEvent:
+		if err := bot.respondToDelete(ctx, db, e); err != nil {
+			log.Printf("info: %s が削除されたトゥートに反応できませんでした", bot.Name)
+		}
+	}
+}
+
+func (bot *Persona) handleNotification(ctx context.Context, db DB, ev *mastodon.NotificationEvent) {
+	if err := bot.respondToNotification(ctx, db, ev); err != nil {
+		log.Printf("info: %s が通知に反応できませんでした", bot.Name)
+	}
+}
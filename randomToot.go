@@ -42,7 +42,7 @@ func (bot *Persona) randomToot(ctx context.Context, db DB) {
 }
 
 func (bot *Persona) newsToot(ctx context.Context, itvl, stock int, db DB) (err error) {
-	if stock == 0 {
+	if stock == 0 || bot.ctl.isPaused() {
 		return
 	}
 
@@ -63,12 +63,8 @@ func (bot *Persona) newsToot(ctx context.Context, itvl, stock int, db DB) (err e
 			return err
 		}
 		if item.Title != "" {
-			if err = bot.post(ctx, toot); err != nil {
+			if err = bot.postNews(ctx, db, toot, item); err != nil {
 				log.Printf("info: %s がトゥートできませんでした。今回は諦めます……", bot.Name)
-			} else {
-				if err = db.deleteItem(bot, item); err != nil {
-					log.Printf("info: %s がトゥート済みアイテムの削除に失敗しました", bot.Name)
-				}
 			}
 		}
 	}
@@ -101,7 +97,7 @@ func (bot *Persona) createSongNewsToot(db DB) (toot mastodon.Toot, item Item, er
 // messageFromItemは、itemの内容から投稿文を作成する。
 func (bot *Persona) messageFromItem(item Item) (msg string, err error) {
 	var hashtagStr string
-	for _, t := range bot.Hashtags {
+	for _, t := range bot.cfg().Hashtags {
 		hashtagStr += `#` + t + " "
 	}
 	hashtagStr = strings.TrimSpace(hashtagStr)
@@ -0,0 +1,85 @@
+package tankabot
+
+import (
+	"log"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// suppressedTanka は、返信を控えた短歌や、まとめて紹介する短歌を格納する。
+type suppressedTanka struct {
+	ID       int
+	StatusID mastodon.ID
+	Acct     string
+	URL      string
+	Tankas   string
+	Reason   string
+}
+
+// replyLogRetention は、返信のログを残しておく期間。返信数は一日分までしか数えない。
+const replyLogRetention = 48 * time.Hour
+
+// replyLimit は、このアカウントへの返信を控えるべき理由を返す。控えなくてよければ空文字列を返す。
+// 上限や間隔がゼロの項目は制限しない。
+func (bot *Persona) replyLimit(db DB, acct string) (reason string) {
+	now := time.Now()
+	hour, day, last, globalHour, err := db.replyCounts(bot, acct, now)
+	if err != nil {
+		log.Printf("info: %s が返信数を確かめられませんでした", bot.Name)
+		return
+	}
+
+	switch {
+	case bot.cfg().ReplyCooldownMin > 0 && now.Sub(last) < time.Duration(bot.cfg().ReplyCooldownMin)*time.Minute:
+		reason = "cooldown"
+	case bot.cfg().RepliesPerHour > 0 && hour >= bot.cfg().RepliesPerHour:
+		reason = "hourly"
+	case bot.cfg().RepliesPerDay > 0 && day >= bot.cfg().RepliesPerDay:
+		reason = "daily"
+	case bot.cfg().GlobalRepliesPerHour > 0 && globalHour >= bot.cfg().GlobalRepliesPerHour:
+		reason = "global"
+	}
+	return
+}
+
+// holdBack は、返信の上限に達していればtrueを返す。まとめて紹介してよい短歌（digestがtrue）なら、後で紹介するために記録する。
+// 上限に達していなければ、返信する前に返信のログに加えておく。返信できなかったら、releaseHoldで取り消す。
+func (bot *Persona) holdBack(db DB, orig *mastodon.Status, tankas string, digest bool) bool {
+	// 数えてからログに加えるまでの間に、ほかのワーカーの返信が割り込んで上限を超えないように
+	bot.replyLock <- 0
+	defer func() { <-bot.replyLock }()
+
+	reason := bot.replyLimit(db, orig.Account.Acct)
+	if reason == "" {
+		if err := db.logReply(bot, orig.ID, replyTanka, orig.Account.Acct); err != nil {
+			log.Printf("info: %s が返信をログに記録できませんでした", bot.Name)
+		}
+		return false
+	}
+	if !digest {
+		log.Printf("info: %s が %s への返信を控えました（%s）", bot.Name, orig.Account.Acct, reason)
+		return true
+	}
+
+	sup := suppressedTanka{StatusID: orig.ID, Acct: orig.Account.Acct, URL: orig.URL, Tankas: tankas, Reason: reason}
+	if err := db.addSuppressed(bot, sup); err != nil {
+		log.Printf("info: %s が控えた短歌を記録できませんでした", bot.Name)
+	}
+	log.Printf("info: %s が %s への返信を控えました（%s）", bot.Name, orig.Account.Acct, reason)
+	return true
+}
+
+// releaseHold は、holdBackで返信のログに加えた返信を、投稿できなかったので取り消す。
+func (bot *Persona) releaseHold(db DB, orig *mastodon.Status) {
+	if err := db.unlogReply(bot, orig.ID, replyTanka); err != nil {
+		log.Printf("info: %s が返信のログを取り消せませんでした", bot.Name)
+	}
+}
+
+// forgetReplyLog は、返信数を数えるのに要らなくなった古い返信のログを削除する。
+func (bot *Persona) forgetReplyLog(db DB) {
+	if err := db.expireReplyLog(bot, time.Now().Add(-replyLogRetention)); err != nil {
+		log.Printf("info: %s が古い返信のログを削除できませんでした", bot.Name)
+	}
+}
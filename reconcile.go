@@ -0,0 +1,222 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+const (
+	followSyncPageLimit = 80              // followSyncPageLimit は、フォロー・フォロワー一覧の一回あたりの取得数。
+	followSyncChangeGap = 5 * time.Second // followSyncChangeGap は、フォローやアンフォローの間に空ける時間。
+	dormantChecksPerRun = 50              // dormantChecksPerRun は、一回の見直しで最終投稿を確かめるアカウントの数の上限。
+)
+
+// syncFollows は、ctxが終わるまで、FollowSyncHoursごとにフォロー関係を見直す。最初の見直しは起きてしばらくしてから。
+func (bot *Persona) syncFollows(ctx context.Context, db DB) {
+	wait := time.Duration(rand.Intn(10)+5) * time.Minute
+	for {
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+
+		if bot.ctl.isPaused() {
+			log.Printf("info: %s は一時停止中なので、フォロー関係の見直しを見送ります", bot.Name)
+		} else if err := bot.reconcileFollows(ctx, db); err != nil {
+			log.Printf("info: %s がフォロー関係を見直せませんでした：%s", bot.Name, err)
+		}
+		wait = time.Duration(bot.FollowSyncHours) * time.Hour
+	}
+}
+
+// reconcileFollows は、フォロワーとフォローの一覧を突き合わせて、フォローバックし損ねた人をフォローする。
+// 設定によっては、フォローしてくれなくなった人や、長く投稿していない人のフォローを外す。
+// 「フォロー解除」を頼まれた人はフォローバックせず、休眠で外した人は、また投稿するようになるまでフォローバックしない。
+// 一回に変えるのはFollowSyncMaxChangesまでで、残りは次回に回す。
+func (bot *Persona) reconcileFollows(ctx context.Context, db DB) (err error) {
+	followers, err := bot.allAccounts(ctx, bot.Client.GetAccountFollowers)
+	if err != nil {
+		return
+	}
+	following, err := bot.allAccounts(ctx, bot.Client.GetAccountFollowing)
+	if err != nil {
+		return
+	}
+
+	left, err := db.unfollowedAccts(bot)
+	if err != nil {
+		return
+	}
+	if err = bot.bootstrapUnfollowed(db, followers, following, left); err != nil {
+		return
+	}
+
+	changes, followed, unfollowed, dormant, deferred, checks := 0, 0, 0, 0, 0, 0
+	change := func(f func(context.Context, mastodon.ID) error, acc *mastodon.Account) bool {
+		if changes >= bot.cfg().FollowSyncMaxChanges {
+			deferred++
+			return false
+		}
+		changes++
+		if !waitFor(ctx, followSyncChangeGap) {
+			return false
+		}
+		return f(ctx, acc.ID) == nil
+	}
+
+	// フォローバックし損ねた人（鍵アカウントは、承認待ちのリクエストが毎回重なるので除く）
+	for id, acc := range followers {
+		if _, ok := following[id]; ok || acc.Locked || !bot.consents(*acc) || bot.blocked(*acc, "") {
+			continue
+		}
+		switch left[acc.Acct] {
+		case unfollowRequested:
+			continue
+		case unfollowDormant:
+			if bot.cfg().DormantDays > 0 {
+				if checks >= dormantChecksPerRun {
+					continue
+				}
+				checks++
+				if bot.isDormant(ctx, acc) {
+					continue
+				}
+			}
+		}
+		if change(bot.follow, acc) {
+			bot.clearUnfollowed(db, acc.Acct)
+			followed++
+			log.Printf("info: %s が %s をフォローバックしました", bot.Name, acc.Acct)
+		}
+	}
+
+	// フォローしてくれなくなった人
+	if bot.cfg().UnfollowNonFollowers {
+		for id, acc := range following {
+			if _, ok := followers[id]; ok || bot.isAdmin(*acc) {
+				continue
+			}
+			if change(bot.unfollow, acc) {
+				unfollowed++
+				delete(following, id)
+				log.Printf("info: %s がフォローしてくれなくなった %s のフォローを外しました", bot.Name, acc.Acct)
+			}
+		}
+	}
+
+	// 長く投稿していない人
+	if bot.cfg().DormantDays > 0 {
+		for _, acc := range following {
+			if bot.isAdmin(*acc) {
+				continue
+			}
+			if checks >= dormantChecksPerRun {
+				break
+			}
+			checks++
+			if !bot.isDormant(ctx, acc) {
+				continue
+			}
+			if change(bot.unfollow, acc) {
+				dormant++
+				if err := db.setUnfollowed(bot, acc.Acct, unfollowDormant); err != nil {
+					log.Printf("info: %s が %s のフォローを外したことを記録できませんでした", bot.Name, acc.Acct)
+				}
+				log.Printf("info: %s が長く投稿していない %s のフォローを外しました", bot.Name, acc.Acct)
+			}
+		}
+	}
+
+	log.Printf("info: %s がフォロー関係を見直しました（フォロワー%d・フォロー%d）。フォローバック%d、フォロー解除%d、休眠によるフォロー解除%d、次回に回したもの%d",
+		bot.Name, len(followers), len(following), followed, unfollowed, dormant, deferred)
+	return
+}
+
+// bootstrapUnfollowed は、初めての見直しの前に、フォローを返していないフォロワーを「フォロー解除」を頼まれた人として記録する。
+// フォローを外した理由を記録するようになる前に「フォロー解除」を頼んだ人を、見直しでフォローし直さないように。
+// フォローし直してくれれば、respondToFollowで記録が消えて、またフォローバックする。
+func (bot *Persona) bootstrapUnfollowed(db DB, followers, following map[mastodon.ID]*mastodon.Account, left map[string]string) (err error) {
+	synced, err := db.followsSyncedAt(bot)
+	if err != nil || !synced.IsZero() {
+		return
+	}
+
+	n := 0
+	for id, acc := range followers {
+		if _, ok := following[id]; ok || left[acc.Acct] != "" {
+			continue
+		}
+		if err = db.setUnfollowed(bot, acc.Acct, unfollowRequested); err != nil {
+			return
+		}
+		left[acc.Acct] = unfollowRequested
+		n++
+	}
+	if err = db.setFollowsSyncedAt(bot, time.Now()); err != nil {
+		return
+	}
+	log.Printf("info: %s が初めてフォロー関係を見直すので、フォローを返していない %d 人はフォローバックしないことにしました", bot.Name, n)
+	return
+}
+
+// waitFor は、dだけ待つ。待っている間にctxが終わったらfalseを返す。
+func waitFor(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// isDormant は、アカウントがDormantDaysより長く投稿していないか、引っ越したかどうかを返す。
+func (bot *Persona) isDormant(ctx context.Context, acc *mastodon.Account) bool {
+	if acc.Moved != nil {
+		return true
+	}
+	limit := time.Now().Add(-time.Duration(bot.cfg().DormantDays) * 24 * time.Hour)
+	if acc.StatusesCount == 0 {
+		return acc.CreatedAt.Before(limit)
+	}
+
+	if !waitFor(ctx, time.Second) {
+		return false
+	}
+	ss, err := bot.Client.GetAccountStatuses(ctx, acc.ID, &mastodon.Pagination{Limit: 1})
+	if err != nil || len(ss) == 0 {
+		return false
+	}
+	return ss[0].CreatedAt.Before(limit)
+}
+
+// allAccounts は、フォロワーやフォローの一覧を最後までたどって、IDをキーにしたマップにする。
+func (bot *Persona) allAccounts(ctx context.Context, get func(context.Context, mastodon.ID, *mastodon.Pagination) ([]*mastodon.Account, error)) (accs map[mastodon.ID]*mastodon.Account, err error) {
+	accs = make(map[mastodon.ID]*mastodon.Account)
+	pg := mastodon.Pagination{Limit: followSyncPageLimit}
+	for {
+		page, err := get(ctx, bot.MyID, &pg)
+		if err != nil {
+			log.Printf("info: %s がフォロー関係の一覧を取得できませんでした：%s", bot.Name, err)
+			return nil, err
+		}
+		for _, a := range page {
+			accs[a.ID] = a
+		}
+		if pg.MaxID == "" || len(page) == 0 {
+			return accs, nil
+		}
+		pg = mastodon.Pagination{MaxID: pg.MaxID, Limit: followSyncPageLimit}
+		if !waitFor(ctx, time.Second) {
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// rengaChain は、進行中の連歌の状態を格納する。
+type rengaChain struct {
+	ID           int
+	RootStatusID mastodon.ID
+	RootAcct     string // RootAcct は、発句を詠んだ人。
+	LastStatusID mastodon.ID
+	LastAcct     string
+	NextForm     string
+	Links        int
+}
+
+// rengaLink は、連歌の一句を格納する。
+type rengaLink struct {
+	StatusID mastodon.ID
+	Acct     string
+	Verse    string
+}
+
+// rengaForms は、連歌で交互に付ける長句と短句。
+var rengaForms = map[string]songForm{
+	"長句": {"長句", []int{5, 7, 5}},
+	"短句": {"短句", []int{7, 7}},
+}
+
+// rengaMaxLinks は、一巻の句数の上限（歌仙）。
+const rengaMaxLinks = 36
+
+// rengaOpen は、連歌の句として受け付ける投稿かどうかを返す。巻き終えた一巻はまとめて投稿するので、人目に触れてよい句だけを受け付ける。
+func rengaOpen(status *mastodon.Status) bool {
+	return status.Visibility == "public" || status.Visibility == "unlisted"
+}
+
+// startRenga は、メンションに書かれた発句を検証して、新しい連歌を始める。
+func (bot *Persona) startRenga(ctx context.Context, db DB, account mastodon.Account, status *mastodon.Status) (err error) {
+	if !rengaOpen(status) {
+		toot := mastodon.Toot{Status: "@" + account.Acct + " 連歌は、巻き終えたら公開でまとめますので、公開か未収載の投稿で始めてください", Visibility: status.Visibility, InReplyToID: status.ID}
+		if err = bot.post(ctx, toot); err != nil {
+			log.Printf("info: %s が連歌をお断りできませんでした", bot.Name)
+		}
+		return
+	}
+
+	verse := strings.ReplaceAll(stripMentions(textContent(status.Content)), "連歌", "")
+	fc := checkAgainst(verse, []songForm{rengaForms["長句"]}, bot.langJobPool)
+	if !fc.valid() {
+		return bot.rejectRengaLink(ctx, account, status, fc, "発句は")
+	}
+
+	link := rengaLink{StatusID: status.ID, Acct: account.Acct, Verse: joinKus(fc)}
+	if err = db.addRengaChain(bot, link); err != nil {
+		log.Printf("info: %s が連歌を登録できませんでした", bot.Name)
+		return
+	}
+
+	msg := "@" + account.Acct + " 発句を承りました！ この句にリプライで短句（七七）を付けてください。「満尾」とリプライすれば巻き終えます"
+	toot := mastodon.Toot{Status: msg, Visibility: stricterVisibility(status.Visibility, "unlisted"), InReplyToID: status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s が連歌の開始を知らせられませんでした", bot.Name)
+	}
+	return
+}
+
+// respondToRenga は、連歌の句へのリプライを付句として検証し、受け付けるか断る。
+func (bot *Persona) respondToRenga(ctx context.Context, db DB, chain rengaChain, account mastodon.Account, status *mastodon.Status) (err error) {
+	vis := stricterVisibility(status.Visibility, "unlisted")
+	reply := func(msg string) error {
+		toot := mastodon.Toot{Status: "@" + account.Acct + " " + msg, Visibility: vis, InReplyToID: status.ID}
+		return bot.post(ctx, toot)
+	}
+
+	if !rengaOpen(status) {
+		return reply("付句は、公開か未収載の投稿でお願いします")
+	}
+	if inReplyTo(status) != chain.LastStatusID {
+		return reply("付句は、いちばん新しい句へのリプライでお願いします")
+	}
+
+	verse := stripMentions(textContent(status.Content))
+	if strings.Contains(verse, "満尾") {
+		if account.Acct != chain.RootAcct && !bot.isAdmin(account) {
+			return reply("巻き終えられるのは、発句を詠んだ方だけです")
+		}
+		return bot.finishRenga(ctx, db, chain)
+	}
+
+	if account.Acct == chain.LastAcct {
+		return reply("同じ方が続けて付けることはできません。どなたかの付句をお待ちください")
+	}
+
+	form := rengaForms[chain.NextForm]
+	fc := checkAgainst(verse, []songForm{form}, bot.langJobPool)
+	if !fc.valid() {
+		return bot.rejectRengaLink(ctx, account, status, fc, "次は")
+	}
+
+	link := rengaLink{StatusID: status.ID, Acct: account.Acct, Verse: joinKus(fc)}
+	linked, err := db.addRengaLink(bot, chain, link)
+	if err != nil {
+		log.Printf("info: %s が付句を登録できませんでした", bot.Name)
+		return
+	}
+	if !linked {
+		return reply("一足先に別の句が付きました。いちばん新しい句にあらためて付けてみてください")
+	}
+
+	// 付句ありがとうのふぁぼ
+	if err = bot.fav(ctx, status.ID); err != nil {
+		log.Printf("info: %s がふぁぼを諦めました", bot.Name)
+	}
+
+	if chain.Links+1 >= rengaMaxLinks {
+		chain.Links++
+		return bot.finishRenga(ctx, db, chain)
+	}
+	return
+}
+
+// rejectRengaLink は、詩型に合わない句に拍数を添えてお断りする。
+func (bot *Persona) rejectRengaLink(ctx context.Context, account mastodon.Account, status *mastodon.Status, fc formCheck, lead string) (err error) {
+	morae := make([]string, 0, len(fc.kus))
+	for _, k := range fc.kus {
+		morae = append(morae, strconv.Itoa(k.morae))
+	}
+	msg := "@" + account.Acct + " " + lead + fc.form.name + "（" + fc.form.pattern() + "）でお願いします。いただいた句は（" + strings.Join(morae, "-") + "）でした"
+	toot := mastodon.Toot{Status: msg, Visibility: stricterVisibility(status.Visibility, "unlisted"), InReplyToID: status.ID}
+	if err = bot.post(ctx, toot); err != nil {
+		log.Printf("info: %s が付句をお断りできませんでした", bot.Name)
+	}
+	return
+}
+
+// finishRenga は、連歌を巻き終えて、全ての句を一つのスレッドにまとめて投稿する。
+func (bot *Persona) finishRenga(ctx context.Context, db DB, chain rengaChain) (err error) {
+	if err = db.finishRengaChain(bot, chain); err != nil {
+		log.Printf("info: %s が連歌を巻き終えられませんでした", bot.Name)
+		return
+	}
+
+	links, err := db.rengaLinks(chain)
+	if err != nil || len(links) == 0 {
+		log.Printf("info: %s が連歌の句を集められませんでした", bot.Name)
+		return
+	}
+
+	participants := make(map[string]bool)
+	for _, l := range links {
+		participants[l.Acct] = true
+	}
+
+	msg := "連歌「" + strings.SplitN(links[0].Verse, " ", 2)[0] + "」の巻、満尾しました（" + strconv.Itoa(len(links)) + "句・" + strconv.Itoa(len(participants)) + "人）"
+	st, err := bot.postStatus(ctx, mastodon.Toot{Status: msg, Visibility: "unlisted"})
+	if err != nil {
+		log.Printf("info: %s が連歌の巻頭を投稿できませんでした", bot.Name)
+		return
+	}
+
+	for i, l := range links {
+		name := "第" + strconv.Itoa(i+1) + "句"
+		switch {
+		case i == 0:
+			name = "発句"
+		case i == 1:
+			name = "脇句"
+		case i == len(links)-1:
+			name = "挙句"
+		}
+		// 参加者に何度も通知が飛ばないよう、アカウント名には@を付けない
+		toot := mastodon.Toot{Status: name + "　" + l.Verse + "　（" + l.Acct + "）", Visibility: "unlisted", InReplyToID: st.ID}
+		next, err := bot.postStatus(ctx, toot)
+		if err != nil {
+			log.Printf("info: %s が連歌の%sを投稿できませんでした。今回は諦めます……", bot.Name, name)
+			return err
+		}
+		st = next
+	}
+	return
+}
+
+// joinKus は、チェック済みの句を空白でつなぐ。
+func joinKus(fc formCheck) string {
+	kus := make([]string, 0, len(fc.kus))
+	for _, k := range fc.kus {
+		kus = append(kus, k.surface)
+	}
+	return strings.Join(kus, " ")
+}
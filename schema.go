@@ -0,0 +1,70 @@
+package tankabot
+
+import (
+	_ "embed" // for go:embed
+	"log"
+	"strings"
+)
+
+// schemaSQL は、テーブル定義。新しく入れる時も、既存のデータベースに足りないテーブルを作る時も、これを使う。
+//
+//go:embed database_tables.sql
+var schemaSQL string
+
+// schemaColumn は、後から既存のテーブルに加えた列と、それを加える文を格納する。
+type schemaColumn struct {
+	Table  string
+	Column string
+	Alter  string
+}
+
+// addedColumns は、database_tables.sql の最初の版より後に、既存のテーブルに加えた列。
+var addedColumns = []schemaColumn{
+	{"bots", "contest_started_at", "ALTER TABLE bots ADD COLUMN contest_started_at datetime DEFAULT NULL AFTER checked_until"},
+	{"bots", "last_status_id", "ALTER TABLE bots ADD COLUMN last_status_id varchar(64) DEFAULT NULL AFTER contest_started_at"},
+	{"replies", "kind", "ALTER TABLE replies ADD COLUMN kind varchar(16) NOT NULL DEFAULT 'tanka' AFTER status_id, DROP PRIMARY KEY, ADD PRIMARY KEY (bot_id, status_id, kind)"},
+	{"account_prefs", "unfollowed", "ALTER TABLE account_prefs ADD COLUMN unfollowed varchar(16) NOT NULL DEFAULT '' AFTER policy"},
+	{"bots", "follows_synced_at", "ALTER TABLE bots ADD COLUMN follows_synced_at datetime DEFAULT NULL AFTER last_status_id"},
+	{"replies", "checked_at", "ALTER TABLE replies ADD COLUMN checked_at datetime DEFAULT NULL AFTER updated_at"},
+}
+
+// migrate は、起動時にデータベースを今のテーブル定義に合わせる。
+// 足りないテーブルを作り、前の版で作ったテーブルに足りない列を加える。
+func (db DB) migrate() (err error) {
+	for _, stmt := range strings.Split(schemaSQL, ";") {
+		stmt = strings.TrimSpace(stmt)
+		if !strings.HasPrefix(stmt, "CREATE TABLE ") {
+			continue
+		}
+		stmt = "CREATE TABLE IF NOT EXISTS " + strings.TrimPrefix(stmt, "CREATE TABLE ")
+		if _, err = db.Exec(stmt); err != nil {
+			log.Printf("alert: テーブルを作成できませんでした：%s", err)
+			return
+		}
+	}
+
+	for _, c := range addedColumns {
+		var n int
+		if err = db.QueryRow(`
+			SELECT
+				COUNT(*)
+			FROM
+				information_schema.COLUMNS
+			WHERE
+				TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`,
+			c.Table, c.Column,
+		).Scan(&n); err != nil {
+			log.Printf("alert: %s テーブルの列を確かめられませんでした：%s", c.Table, err)
+			return
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err = db.Exec(c.Alter); err != nil {
+			log.Printf("alert: %s テーブルに %s 列を加えられませんでした：%s", c.Table, c.Column, err)
+			return
+		}
+		log.Printf("info: %s テーブルに %s 列を加えました", c.Table, c.Column)
+	}
+	return
+}
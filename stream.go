@@ -0,0 +1,170 @@
+package tankabot
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+const (
+	minReconnectInterval = time.Second
+	maxReconnectInterval = 5 * time.Minute
+	stableConnection     = time.Minute // stableConnection は、これより長く続いた接続の後はバックオフを最小に戻す。
+)
+
+// StreamStatus は、ストリーミング接続の状態のスナップショット。
+type StreamStatus struct {
+	Name       string
+	Connected  bool
+	Since      time.Time // Since は、現在の状態（接続中か切断中か）になった時刻。
+	Reconnects int
+	Failures   int // Failures は、連続して失敗した接続の回数。
+	LastError  string
+}
+
+// streamState は、ストリーミング接続の状態を格納する。
+type streamState struct {
+	mu     sync.Mutex
+	status StreamStatus
+}
+
+// newStreamStates は、botが張るストリーミング接続の状態を用意する。
+func newStreamStates() map[string]*streamState {
+	return map[string]*streamState{
+		"user":    {status: StreamStatus{Name: "user"}},
+		"hashtag": {status: StreamStatus{Name: "hashtag"}},
+		"polling": {status: StreamStatus{Name: "polling"}},
+	}
+}
+
+func (s *streamState) up() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Connected = true
+	s.status.Since = time.Now()
+}
+
+// down は切断を記録する。healthyでなかった接続は、連続失敗として数える。
+func (s *streamState) down(healthy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Connected = false
+	s.status.Since = time.Now()
+	if healthy {
+		s.status.Failures = 0
+	} else {
+		s.status.Failures++
+	}
+}
+
+// reset は、その日の接続を始める前に、前の日の回数を消す。
+func (s *streamState) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Connected = false
+	s.status.Reconnects = 0
+	s.status.Failures = 0
+	s.status.LastError = ""
+}
+
+func (s *streamState) reconnecting() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Reconnects++
+}
+
+func (s *streamState) setError(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.LastError = msg
+}
+
+func (s *streamState) snapshot() StreamStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// StreamStatuses は、botのストリーミング接続の状態を返す。
+func (bot *Persona) StreamStatuses() (ss []StreamStatus) {
+	for _, s := range bot.streams {
+		ss = append(ss, s.snapshot())
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Name < ss[j].Name })
+	return
+}
+
+// supervise は、ストリーミング接続を張り続けてイベントをhandleに渡す。
+// 接続が切れたら、指数バックオフにジッターを加えた間隔を置いて、ctxが生きている限り何度でも再接続する。
+// maxFailuresが正なら、その回数だけ続けて接続に失敗したところで諦め、gaveUpをtrueにして戻る。
+// reconnectedがnilでなければ、一度つながった後に切れて、またつながるたびに呼ぶ。
+// 接続の失敗はエラーイベントで届くので、エラーでないイベントを初めて受け取った時に、つながったとみなす。
+func (bot *Persona) supervise(ctx context.Context, st *streamState, maxFailures int, open func(context.Context) (chan mastodon.Event, error), reconnected func(context.Context), handle func(context.Context, mastodon.Event)) (gaveUp bool) {
+	st.reset()
+	backoff := minReconnectInterval
+	wasUp := false
+	for {
+		sessCtx, cancel := context.WithCancel(ctx)
+		start := time.Now()
+		evch, err := open(sessCtx)
+		if err != nil {
+			st.setError(err.Error())
+			log.Printf("info: %s のストリーミング受信が開始できません：%s", bot.Name, err)
+		} else {
+			established := false
+			for ev := range evch {
+				if e, ok := ev.(*mastodon.ErrorEvent); ok {
+					st.setError(e.Error())
+					log.Printf("info: %s がエラーイベントを受信しました：%s", bot.Name, e.Error())
+					continue
+				}
+				if !established {
+					established = true
+					st.up()
+					if reconnected != nil && wasUp {
+						reconnected(ctx)
+					}
+					wasUp = true
+				}
+				handle(ctx, ev)
+			}
+		}
+		cancel()
+
+		healthy := err == nil && time.Since(start) >= stableConnection
+		st.down(healthy)
+		if ctx.Err() != nil {
+			return
+		}
+		if healthy {
+			backoff = minReconnectInterval
+		}
+		s := st.snapshot()
+		if maxFailures > 0 && s.Failures >= maxFailures {
+			log.Printf("info: %s の %s ストリーミングが%d回続けて失敗したので、諦めます：%s", bot.Name, s.Name, s.Failures, s.LastError)
+			return true
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Printf("info: %s の %s ストリーミングが切れました（連続失敗%d回・再接続%d回）。%s後に再接続します：%s", bot.Name, s.Name, s.Failures, s.Reconnects, wait.Round(time.Millisecond), s.LastError)
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+		st.reconnecting()
+
+		backoff *= 2
+		if backoff > maxReconnectInterval {
+			backoff = maxReconnectInterval
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"os/exec"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/comail/colog"
@@ -54,15 +56,18 @@ func Initialize() (bot Persona, db DB, err error) {
 	var cr map[string]string
 
 	// bot設定ファイル読み込み
-	conf := viper.New()
-	conf.SetConfigName("config")
-	conf.AddConfigPath(".")
-	conf.SetConfigType("yaml")
-	if err := conf.ReadInConfig(); err != nil {
-		log.Printf("alert: 設定ファイルが読み込めませんでした")
+	conf, err := readConfig()
+	if err != nil {
 		return bot, db, err
 	}
 	conf.UnmarshalKey("Persona", &bot)
+	bot.normalize(conf)
+	s, err := readSettings(conf)
+	if err != nil {
+		return bot, db, err
+	}
+	bot.live = new(atomic.Pointer[settings])
+	bot.live.Store(s)
 	var cmn commonSettings
 	cmn.maxRetry = 5
 	cmn.retryInterval = time.Duration(5) * time.Second
@@ -75,6 +80,13 @@ func Initialize() (bot Persona, db DB, err error) {
 	}
 	cmn.langJobPool = make(chan int, nOfJobs)
 	bot.commonSettings = &cmn
+	bot.streams = newStreamStates()
+	bot.backfillLock = make(chan int, 1)
+	bot.replyLock = make(chan int, 1)
+	bot.events = newEventQueue(bot.EventQueueSize)
+	bot.consent = newConsentCache(time.Duration(bot.ConsentCacheMin) * time.Minute)
+	bot.blocks = newBlockList()
+	bot.ctl = newControl()
 	cr = conf.GetStringMapString("DBCredentials")
 
 	// botをMastodonサーバに接続し、アカウントIDを取得
@@ -90,6 +102,12 @@ func Initialize() (bot Persona, db DB, err error) {
 		return bot, db, err
 	}
 
+	// テーブルと列が足りなければ作る
+	if err = db.migrate(); err != nil {
+		log.Printf("alert: データベースのテーブルを最新にできませんでした")
+		return bot, db, err
+	}
+
 	// botがまだデータベースに登録されていなかったら登録
 	if err = db.addNewBot(&bot); err != nil {
 		log.Printf("alert: データベースにbotが登録できませんでした")
@@ -118,6 +136,93 @@ func Initialize() (bot Persona, db DB, err error) {
 	return
 }
 
+// readConfig は、config.ymlを読み込む。
+func readConfig() (conf *viper.Viper, err error) {
+	conf = viper.New()
+	conf.SetConfigName("config")
+	conf.AddConfigPath(".")
+	conf.SetConfigType("yaml")
+	if err = conf.ReadInConfig(); err != nil {
+		log.Printf("alert: 設定ファイルが読み込めませんでした")
+	}
+	return
+}
+
+// normalize は、設定ファイルから読み込んだbotの設定の省略や誤りを補う。
+func (bot *Persona) normalize(conf *viper.Viper) {
+	bot.ContestHashtag = strings.TrimPrefix(bot.ContestHashtag, "#")
+	if bot.ContestDays <= 0 {
+		bot.ContestDays = 30
+	}
+	if bot.ContestWinners <= 0 {
+		bot.ContestWinners = 3
+	}
+	switch bot.StreamingMode = strings.ToLower(bot.StreamingMode); bot.StreamingMode {
+	case "streaming", "polling":
+	default:
+		bot.StreamingMode = "auto"
+	}
+	if bot.PollingMinSec <= 0 {
+		bot.PollingMinSec = 30
+	}
+	if bot.PollingMaxSec < bot.PollingMinSec {
+		bot.PollingMaxSec = bot.PollingMinSec * 10
+	}
+	if bot.EventWorkers <= 0 {
+		bot.EventWorkers = 4
+	}
+	if bot.EventQueueSize <= 0 {
+		bot.EventQueueSize = 100
+	}
+	if bot.ConsentCacheMin <= 0 {
+		bot.ConsentCacheMin = 60
+	}
+	if bot.FollowSyncHours < 0 {
+		bot.FollowSyncHours = 0
+	}
+}
+
+// readSettings は、設定ファイルから、動いているbotに反映できる設定を読み込んで、省略や誤りを補う。
+func readSettings(conf *viper.Viper) (s *settings, err error) {
+	s = new(settings)
+	if err = conf.UnmarshalKey("Persona", s); err != nil {
+		log.Printf("alert: 設定ファイルの内容が読み込めませんでした：%s", err)
+		return nil, err
+	}
+
+	if s.BackfillMaxHours <= 0 {
+		s.BackfillMaxHours = 12
+	}
+	if !conf.IsSet("Persona.BackfillMaxReplies") {
+		s.BackfillMaxReplies = 5
+	} else if s.BackfillMaxReplies < 0 {
+		s.BackfillMaxReplies = 0
+	}
+	if !conf.IsSet("Persona.OptOutMarkers") {
+		s.OptOutMarkers = []string{"#nobot", "#notanka"}
+	}
+	if !conf.IsSet("Persona.QuietWords") {
+		s.QuietWords = defaultQuietWords
+	}
+	if s.ReplyPolicy = strings.ToLower(s.ReplyPolicy); !validPolicy(s.ReplyPolicy) {
+		s.ReplyPolicy = policyThread
+	}
+	switch s.FollowRequestRule = strings.ToLower(s.FollowRequestRule); s.FollowRequestRule {
+	case "all", "local":
+	default:
+		s.FollowRequestRule = "manual"
+	}
+	if s.FollowSyncMaxChanges <= 0 {
+		s.FollowSyncMaxChanges = 10
+	}
+	for _, n := range []*int{&s.RepliesPerHour, &s.RepliesPerDay, &s.GlobalRepliesPerHour, &s.ReplyCooldownMin, &s.FollowRequestMinAgeDays, &s.DormantDays} {
+		if *n < 0 {
+			*n = 0
+		}
+	}
+	return
+}
+
 // ActivateBot は、botを活動させる。
 func ActivateBot(bot *Persona, db DB, p int) (err error) {
 	// 全てをシャットダウンするタイムアウトの設定
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"log"
 	"os/exec"
+	"regexp"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -14,6 +15,7 @@ import (
 // mecabNode はMecabで分節されたノードとそのメタデータを含む構造体。
 type mecabNode struct {
 	surface      string
+	reading      string
 	moraCount    int
 	dependent    bool // dependent はそのノードが付属語かどうか。
 	divisible    bool // divisible はそのノードで区切れができるかどうか。
@@ -216,6 +218,7 @@ func parse(str string, jpl chan int) (nodes []mecabNode) {
 		switch {
 		case isWord(props):
 			node.surface = props[0]
+			node.reading = props[8]
 			node.moraCount = moraCount(props[8])
 			node.dependent = isDependent(props)
 			node.divisible = isDivisible(node.dependent, props)
@@ -223,6 +226,7 @@ func parse(str string, jpl chan int) (nodes []mecabNode) {
 			node.nounOrSymbol = isNoun(props)
 		case isKatakana(props):
 			node.surface = props[0]
+			node.reading = props[0]
 			node.moraCount = moraCount(props[0])
 			node.dependent = false
 			node.divisible = true
@@ -315,6 +319,18 @@ func isNoun(props []string) bool {
 	return props[1] == "名詞" || props[1] == "連体詞"
 }
 
+// reading は文字列の読みをカタカナで返す。読みのわからない部分は表記のまま残す。
+func reading(str string, jpl chan int) (r string) {
+	for _, n := range parse(str, jpl) {
+		if n.reading != "" {
+			r += n.reading
+		} else if n.moraCount > 0 {
+			r += n.surface
+		}
+	}
+	return
+}
+
 // moraCount は文字列が何拍で発音されるかを返す。
 func moraCount(word string) (count int) {
 	rep := strings.NewReplacer("ァ", "", "ィ", "", "ゥ", "", "ェ", "", "ォ", "", "ャ", "", "ュ", "", "ョ", "", "ヮ", "")
@@ -334,6 +350,14 @@ func isJap(text string) bool {
 	return false
 }
 
+// mentionRegexp はテキスト中のメンション（@user または @user@domain）にマッチする。
+var mentionRegexp = regexp.MustCompile(`@[A-Za-z0-9_]+(@[A-Za-z0-9.\-]+)?`)
+
+// stripMentions はテキストからメンションを取り除く。
+func stripMentions(text string) string {
+	return strings.TrimSpace(mentionRegexp.ReplaceAllString(text, ""))
+}
+
 // textContent はhtmlからテキストを抽出する。
 // https://github.com/mattn/go-mastodon/blob/master/cmd/mstdn/main.go より拝借
 func textContent(s string) string {